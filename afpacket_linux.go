@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/afpacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/gopacket/gopacket/pcap"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/net/bpf"
+)
+
+// afpacketStatsInterval is how often the kernel drop counters are checked
+const afpacketStatsInterval = 10 * time.Second
+
+// afpacketSource is one of the AF_PACKET TPACKET_V3 sockets capturing an
+// interface. It implements packetSource
+type afpacketSource struct {
+	*afpacket.TPacket
+	linkType layers.LinkType
+	// closed is shared by the sockets of an interface, and closed along with
+	// the first one of them
+	closed    chan struct{}
+	closeOnce *sync.Once
+}
+
+// LinkType returns the link type of the interface
+func (a *afpacketSource) LinkType() layers.LinkType {
+	return a.linkType
+}
+
+// ReadPacketData returns the next packet, truncated to --snaplen
+func (a *afpacketSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	for {
+		data, ci, err := a.TPacket.ReadPacketData()
+		if errors.Is(err, afpacket.ErrTimeout) {
+			continue
+		}
+		if len(data) > generalOptions.SnapLen {
+			data = data[:generalOptions.SnapLen]
+			ci.CaptureLength = len(data)
+		}
+		return data, ci, err
+	}
+}
+
+// Close closes the socket and stops reporting the drops of its interface
+func (a *afpacketSource) Close() {
+	a.closeOnce.Do(func() { close(a.closed) })
+	a.TPacket.Close()
+}
+
+// afpacketLinkType maps the ARPHRD type of an interface to the link type of
+// the frames read from its AF_PACKET sockets
+func afpacketLinkType(name string) (layers.LinkType, error) {
+	b, err := os.ReadFile(filepath.Join("/sys/class/net", name, "type"))
+	if err != nil {
+		return 0, err
+	}
+	arphrd, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0, err
+	}
+	switch arphrd {
+	case 1, 772: // ARPHRD_ETHER, ARPHRD_LOOPBACK
+		return layers.LinkTypeEthernet, nil
+	case 65534: // ARPHRD_NONE, such as tun and WireGuard
+		return layers.LinkTypeRaw, nil
+	}
+	return 0, fmt.Errorf("%s has ARPHRD type %d, which is not supported with AF_PACKET", name, arphrd)
+}
+
+// openAFPacket opens --afpacket-fanout memory mapped TPACKET_V3 sockets on an
+// interface, sharing its packets with PACKET_FANOUT by flow hash
+func openAFPacket(name, filter string) ([]packetSource, error) {
+	if name == "any" {
+		return nil, fmt.Errorf("the any interface can't be captured with AF_PACKET")
+	}
+	// AF_PACKET timestamps are taken by the kernel, adapter timestamps would
+	// need SO_TIMESTAMPING
+	if generalOptions.TimeStampType != "" && generalOptions.TimeStampType != "host" {
+		return nil, fmt.Errorf("only the host time stamp type is supported with AF_PACKET")
+	}
+	linkType, err := afpacketLinkType(name)
+	if err != nil {
+		return nil, err
+	}
+	var instructions []bpf.RawInstruction
+	if filter != "" {
+		compiled, err := pcap.CompileBPFFilter(linkType, 65536, filter)
+		if err != nil {
+			return nil, err
+		}
+		for _, i := range compiled {
+			instructions = append(instructions, bpf.RawInstruction{Op: i.Code, Jt: i.Jt, Jf: i.Jf, K: i.K})
+		}
+	}
+
+	workers := max(generalOptions.AFPacketFanout, 1)
+	closed := make(chan struct{})
+	closeOnce := &sync.Once{}
+	options := []interface{}{
+		afpacket.OptInterface(name),
+		afpacket.OptTPacketVersion(afpacket.TPacketVersion3),
+		afpacket.OptBlockSize(generalOptions.AFPacketBlockSize),
+		afpacket.OptNumBlocks(generalOptions.AFPacketBlocks),
+	}
+	// blocks are handed over once full, or once their timeout expired
+	if generalOptions.Immediate {
+		options = append(options, afpacket.OptBlockTimeout(time.Millisecond))
+	} else if generalOptions.ReadTimeout > 0 {
+		options = append(options, afpacket.OptBlockTimeout(generalOptions.ReadTimeout))
+	}
+	var sources []packetSource
+	var rings []*afpacket.TPacket
+	fail := func(err error) ([]packetSource, error) {
+		for _, source := range sources {
+			closeSource(source)
+		}
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	// the fanout group is only shared by the sockets of this interface
+	iface, err := os.ReadFile(filepath.Join("/sys/class/net", name, "ifindex"))
+	if err != nil {
+		return fail(err)
+	}
+	ifindex, _ := strconv.Atoi(strings.TrimSpace(string(iface)))
+	group := uint16(os.Getpid()<<4 ^ ifindex)
+	for i := 0; i < workers; i++ {
+		ring, err := afpacket.NewTPacket(options...)
+		if err != nil {
+			return fail(err)
+		}
+		sources = append(sources, &afpacketSource{TPacket: ring, linkType: linkType, closed: closed, closeOnce: closeOnce})
+		rings = append(rings, ring)
+		if instructions != nil {
+			if err := ring.SetBPF(instructions); err != nil {
+				return fail(err)
+			}
+		}
+		if err := ring.SetPromiscuous(!generalOptions.NoPromisc); err != nil {
+			return fail(err)
+		}
+		if workers > 1 {
+			if err := ring.SetFanout(afpacket.FanoutHash, group); err != nil {
+				return fail(err)
+			}
+		}
+		if err := ring.InitSocketStats(); err != nil {
+			return fail(err)
+		}
+	}
+	log.Info().Msgf("Using Device: %s (AF_PACKET, %d sockets)", name, workers)
+	log.Info().Msgf("Filter: %s", filter)
+	go reportAFPacketDrops(name, rings, closed)
+	return sources, nil
+}
+
+// reportAFPacketDrops logs the packets dropped by the kernel on the sockets of
+// an interface, until they are closed
+func reportAFPacketDrops(name string, rings []*afpacket.TPacket, closed <-chan struct{}) {
+	ticker := time.NewTicker(afpacketStatsInterval)
+	defer ticker.Stop()
+	var reported uint
+	for {
+		select {
+		case <-closed:
+			return
+		case <-ticker.C:
+		}
+		var packets, drops, freezes uint
+		for _, ring := range rings {
+			_, stats, err := ring.SocketStats()
+			if err != nil {
+				return
+			}
+			packets += stats.Packets()
+			drops += stats.Drops()
+			freezes += stats.QueueFreezes()
+		}
+		if drops > reported {
+			log.Warn().Msgf("%s: the kernel dropped %d of %d packets, the ring was full %d times. Try a bigger --afpacket-block-size, --afpacket-blocks or --afpacket-fanout", name, drops, packets, freezes)
+			reported = drops
+		}
+	}
+}
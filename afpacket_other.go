@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func openAFPacket(name, filter string) ([]packetSource, error) {
+	return nil, errors.New("AF_PACKET capture is only supported on Linux")
+}
@@ -1,37 +1,256 @@
 package main
 
 import (
-	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
 	"os"
-	"time"
+	"strconv"
+	"strings"
 
 	"github.com/rs/zerolog/log"
 
 	"github.com/gopacket/gopacket"
 	"github.com/gopacket/gopacket/layers"
 	"github.com/gopacket/gopacket/pcap"
-	"github.com/gopacket/gopacket/pcapgo"
-	"github.com/lunixbochs/struc"
 )
 
 type packetMetaDataKey struct {
 	LocalPort, RemotePort uint16
 }
 
+// packetMetaData is the attribution of a packet, written to its trailer by
+// packTrailer. Magic is tcpSharkMagic once the packet has been looked up
 type packetMetaData struct {
-	Magic   uint32 `struc:"int32"`
-	Pid     uint32 `struc:"uint32"`
-	CmdLen  uint8  `struc:"uint8,sizeof=Cmd"` // max Cmd is 255 chars
-	Cmd     string
-	ArgsLen uint16 `struc:"uint16,sizeof=Args"` // max args is 65535 chars
-	Args    string
+	Magic     uint32
+	Pid       uint32
+	Cmd       string
+	Args      string
+	Inode     uint64 // socket inode, 0 if unknown
+	Cookie    uint64 // kernel socket cookie, 0 if unknown
+	UID       uint32 // socket owner, 0 if unknown
+	Cgroup    string // cgroup of the socket reported by eBPF, or --cgroup
+	Direction uint8
+	Source    uint8
+	Index     uint32 // index in the process inventory, 0 if unused
 }
 
-func initializeLivePcap(devName, filter string) *pcap.Handle {
+// packetMetaData.Direction of a packet, relative to its process
+const (
+	directionUnknown  = 0
+	directionOutgoing = 1
+	directionIncoming = 2
+)
+
+// packetMetaData.Source, how a packet was attributed, which tells how much the
+// attribution can be trusted
+const (
+	sourceNone        = 0
+	sourceSocketTable = 1 // polled socket tables, the socket may be stale
+	sourceEBPF        = 2 // socket events streamed by eBPF
+	sourceJournal     = 3 // journal recorded by --journal-write
+	sourceFragment    = 4 // first fragment of the datagram
+	sourceCgroup      = 5 // cgroup of the packet, no socket matched
+	sourceTunnel      = 6 // tunnel terminated in the kernel
+	sourceCookie      = 7 // socket cookie of a cgroup packet, reported by eBPF
+)
+
+// cgroupPacket is the per-packet information of a packet captured from a
+// cgroup. It's carried in gopacket.CaptureInfo.AncillaryData
+type cgroupPacket struct {
+	CgroupID     uint64
+	CgroupName   string
+	SocketCookie uint64
+	UID          uint32
+	Ifindex      uint32
+	Egress       bool
+}
+
+// cgroupOf returns the cgroup information of a packet, if it was captured
+// from a cgroup
+func cgroupOf(ci gopacket.CaptureInfo) (cgroupPacket, bool) {
+	for _, a := range ci.AncillaryData {
+		if cg, ok := a.(cgroupPacket); ok {
+			return cg, true
+		}
+	}
+	return cgroupPacket{}, false
+}
+
+// ipProtocolDCCP is not decoded by gopacket, so DCCP ports are read straight
+// from the IP payload
+const ipProtocolDCCP layers.IPProtocol = 33
+
+// transportPorts returns the source and destination ports of a layer that
+// carries them. ok is false for any other layer
+func transportPorts(layer gopacket.Layer) (srcPort, dstPort uint16, ok bool) {
+	switch l := layer.(type) {
+	case *layers.TCP:
+		return uint16(l.SrcPort), uint16(l.DstPort), true
+	case *layers.UDP:
+		return uint16(l.SrcPort), uint16(l.DstPort), true
+	case *layers.UDPLite:
+		return uint16(l.SrcPort), uint16(l.DstPort), true
+	case *layers.SCTP:
+		return uint16(l.SrcPort), uint16(l.DstPort), true
+	case *layers.IPv4:
+		// only the first fragment carries the DCCP header
+		if l.Protocol == ipProtocolDCCP && l.FragOffset == 0 {
+			return dccpPorts(l.Payload)
+		}
+	case *layers.IPv6:
+		if l.NextHeader == ipProtocolDCCP {
+			return dccpPorts(l.Payload)
+		}
+	}
+	return 0, 0, false
+}
+
+// transportProtocol returns the IP protocol of a layer for which
+// transportPorts returns ports
+func transportProtocol(layer gopacket.Layer) layers.IPProtocol {
+	switch layer.(type) {
+	case *layers.TCP:
+		return layers.IPProtocolTCP
+	case *layers.UDP:
+		return layers.IPProtocolUDP
+	case *layers.UDPLite:
+		return layers.IPProtocolUDPLite
+	case *layers.SCTP:
+		return layers.IPProtocolSCTP
+	}
+	return ipProtocolDCCP
+}
+
+// dccpPorts reads the ports from the start of a DCCP generic header
+func dccpPorts(payload []byte) (srcPort, dstPort uint16, ok bool) {
+	if len(payload) < 4 {
+		return 0, 0, false
+	}
+	return binary.BigEndian.Uint16(payload[0:2]), binary.BigEndian.Uint16(payload[2:4]), true
+}
+
+// packetSource is a source of packets of a single link type, such as a
+// pcap.Handle
+type packetSource interface {
+	gopacket.PacketDataSource
+	LinkType() layers.LinkType
+}
+
+// DLT_RAW, as returned by pcap_datalink for raw IP interfaces such as tun and
+// WireGuard, is not LINKTYPE_RAW used in files
+const (
+	dltRaw        layers.LinkType = 12
+	dltRawOpenBSD layers.LinkType = 14
+)
+
+// supportedLinkType returns the link type written for a source link type, or
+// false if tcpshark can't carry metadata on it
+func supportedLinkType(linkType layers.LinkType) (layers.LinkType, bool) {
+	switch linkType {
+	case dltRaw, dltRawOpenBSD:
+		return layers.LinkTypeRaw, true
+	case layers.LinkTypeEthernet,
+		layers.LinkTypeNull,
+		layers.LinkTypeLoop,
+		layers.LinkTypeRaw,
+		layers.LinkTypeIPv4,
+		layers.LinkTypeIPv6,
+		layers.LinkTypeLinuxSLL,
+		layers.LinkTypeLinuxSLL2:
+		return linkType, true
+	}
+	return linkType, false
+}
+
+// networkLayers returns the layers of a packet that follow its link layer
+func networkLayers(packet gopacket.Packet) []gopacket.Layer {
+	all := packet.Layers()
+	if len(all) == 0 {
+		return nil
+	}
+	switch all[0].(type) {
+	case *layers.IPv4, *layers.IPv6:
+		return all
+	}
+	return all[1:]
+}
+
+// frameWithTrailer returns the bytes of a packet with trailer appended right
+// after its IP packet, dropping any padding. It's how the metadata is carried
+// on link types other than Ethernet, as the Lua dissector finds the trailer
+// from the IP header whatever the link type
+func frameWithTrailer(packet gopacket.Packet, trailer []byte) []byte {
+	data := packet.Data()
+	end := len(data)
+	start := 0
+walk:
+	for _, layer := range packet.Layers() {
+		switch l := layer.(type) {
+		case *layers.IPv4:
+			end = start + int(l.Length)
+			break walk
+		case *layers.IPv6:
+			// a zero payload length is a jumbogram, which takes the whole frame
+			if l.Length != 0 {
+				end = start + 40 + int(l.Length)
+			}
+			break walk
+		}
+		start += len(layer.LayerContents())
+	}
+	end = min(end, len(data))
+	frame := make([]byte, 0, end+len(trailer))
+	frame = append(frame, data[:end]...)
+	return append(frame, trailer...)
+}
+
+// openLivePcap opens an interface for capture with the capture parameters of
+// the command line
+func openLivePcap(devName, filter string) (*pcap.Handle, error) {
+	inactive, err := pcap.NewInactiveHandle(devName)
+	if err != nil {
+		return nil, err
+	}
+	defer inactive.CleanUp()
+	timeout := pcap.BlockForever
+	if generalOptions.ReadTimeout > 0 {
+		timeout = generalOptions.ReadTimeout
+	}
+	if err := inactive.SetSnapLen(generalOptions.SnapLen); err != nil {
+		return nil, err
+	}
+	if err := inactive.SetPromisc(!generalOptions.NoPromisc); err != nil {
+		return nil, err
+	}
+	if err := inactive.SetTimeout(timeout); err != nil {
+		return nil, err
+	}
+	if generalOptions.BufferSize > 0 {
+		if err := inactive.SetBufferSize(generalOptions.BufferSize * 1024); err != nil {
+			return nil, err
+		}
+	}
+	if err := inactive.SetImmediateMode(generalOptions.Immediate); err != nil {
+		return nil, err
+	}
+	if generalOptions.TimeStampType != "" {
+		source, err := pcap.TimestampSourceFromString(generalOptions.TimeStampType)
+		if err == nil {
+			err = inactive.SetTimestampSource(source)
+		}
+		if err != nil {
+			var supported []string
+			for _, s := range inactive.SupportedTimestamps() {
+				supported = append(supported, s.String())
+			}
+			return nil, fmt.Errorf("%s doesn't support the %s time stamp type, it supports: %s", devName, generalOptions.TimeStampType, strings.Join(supported, ", "))
+		}
+	}
 	// Open device
-	handle, err := pcap.OpenLive(devName, 65536, true, pcap.BlockForever)
+	handle, err := inactive.Activate()
 	if err != nil {
-		log.Fatal().Msg(err.Error())
+		return nil, fmt.Errorf("%s: %w", devName, err)
 	}
 
 	// Set Filter
@@ -39,93 +258,331 @@ func initializeLivePcap(devName, filter string) *pcap.Handle {
 	log.Info().Msgf("Filter: %s", filter)
 	err = handle.SetBPFFilter(filter)
 	if err != nil {
-		log.Fatal().Msg(err.Error())
+		handle.Close()
+		return nil, err
 	}
 
-	return handle
+	return handle, nil
 }
 
-// blocking function to grab packets
-func capture() {
-	// set up inpput handle
-	var outputHandle *pcapgo.NgWriter
-	if generalOptions.OutFile == "-" {
-		var err error
-		outputHandle, err = pcapgo.NewNgWriter(os.Stdout, 1)
-		if err != nil {
-			panic(err)
+// writeProcEvents writes the process events as custom blocks as they come,
+// so they aren't dropped while no packet is captured. It never returns
+func writeProcEvents(ng *ngWriter) {
+	for ev := range procEvents {
+		data, ok := packProcEvent(ev)
+		if !ok {
+			continue
 		}
-	} else {
-		f, err := os.OpenFile(string(generalOptions.OutFile), os.O_RDWR|os.O_CREATE, 0o755)
-		if err != nil {
+		if err := ng.writeCustomBlock(customRecordProcEvent, data); err != nil {
 			log.Warn().Msg(err.Error())
 		}
-		defer f.Close()
-		outputHandle, err = pcapgo.NewNgWriter(f, 1)
-		if err != nil {
-			panic(err)
+		ng.flush()
+	}
+}
+
+// offlinePcap is a pcap or pcapng file being annotated, with the timestamp
+// resolution of the file rather than the nanoseconds libpcap reads it with
+type offlinePcap struct {
+	*pcap.Handle
+	resolution gopacket.TimestampResolution
+}
+
+// Resolution returns the timestamp resolution of the file
+func (o offlinePcap) Resolution() gopacket.TimestampResolution {
+	return o.resolution
+}
+
+// initializeOfflinePcap opens a pcap or pcapng file to be annotated. '-'
+// reads the file from stdin, whose timestamp resolution is unknown
+func initializeOfflinePcap(fileName, filter string) offlinePcap {
+	var handle *pcap.Handle
+	var err error
+	if fileName == "-" {
+		handle, err = pcap.OpenOfflineFile(os.Stdin)
+	} else {
+		handle, err = pcap.OpenOffline(fileName)
+	}
+	if err != nil {
+		log.Fatal().Msg(err.Error())
+	}
+	// Set Filter
+	log.Info().Msgf("Reading File: %s", fileName)
+	log.Info().Msgf("Filter: %s", filter)
+	err = handle.SetBPFFilter(filter)
+	if err != nil {
+		log.Fatal().Msg(err.Error())
+	}
+
+	if fileName == "-" {
+		return offlinePcap{handle, gopacket.TimestampResolutionNanosecond}
+	}
+	return offlinePcap{handle, fileResolution(fileName)}
+}
+
+// captureOutput is the pcapng output of a capture. Interfaces can be added
+// while capturing
+type captureOutput struct {
+	ng        *ngWriter
+	linkTypes []layers.LinkType
+}
+
+// addInterface adds a source as an interface of the output, keeping its link
+// type and timestamp resolution, and returns its interface index. comment
+// describes the interface in its Interface Description Block
+func (o *captureOutput) addInterface(name string, source packetSource, comment string) (int, error) {
+	linkType, ok := supportedLinkType(source.LinkType())
+	if !ok {
+		return 0, fmt.Errorf("%s has link type %s, which is not supported", name, linkType)
+	}
+	id, err := o.ng.addInterface(ngInterface{
+		name:     name,
+		linkType: linkType,
+		tsresol:  resolutionDigits(timestampResolution(source)),
+		comment:  comment,
+		options:  fcsOptions(linkType),
+	})
+	if err != nil {
+		return 0, err
+	}
+	o.linkTypes = append(o.linkTypes, linkType)
+	return id, nil
+}
+
+// selectedPids and selectedCommands are the processes of --process, given by
+// pid or by command. Both are nil without --process
+var (
+	selectedPids     map[uint32]bool
+	selectedCommands map[string]bool
+)
+
+// parseProcesses splits the processes of --process into pids and commands
+func parseProcesses(list []string) (map[uint32]bool, map[string]bool) {
+	if len(list) == 0 {
+		return nil, nil
+	}
+	pids, commands := make(map[uint32]bool), make(map[string]bool)
+	for _, l := range list {
+		for _, p := range strings.Split(l, ",") {
+			p = strings.TrimSpace(p)
+			if pid, err := strconv.ParseUint(p, 10, 32); err == nil {
+				pids[uint32(pid)] = true
+			} else if p != "" {
+				commands[p] = true
+			}
 		}
-		// generate a packet
 	}
-	inputHandle := initializeLivePcap(generalOptions.Interface, generalOptions.Bpf)
+	return pids, commands
+}
 
-	for {
-		packet, _, err := inputHandle.ReadPacketData()
-		if err != nil {
-			log.Fatal().Msg(err.Error())
+// processSelected reports whether a packet belongs to one of the processes of
+// --process
+func processSelected(records ...*packetMetaData) bool {
+	if selectedPids == nil && selectedCommands == nil {
+		return true
+	}
+	for _, m := range records {
+		if m == nil || m.Magic != tcpSharkMagic {
+			continue
+		}
+		if (m.Pid != 0 && selectedPids[m.Pid]) || selectedCommands[m.Cmd] {
+			return true
 		}
+	}
+	return false
+}
 
-		ethPacket := gopacket.NewPacket(
-			packet,
-			layers.LayerTypeEthernet,
-			gopacket.Default,
-		)
+// packetOptions returns the pcapng options of an annotated packet, carried
+// in gopacket.CaptureInfo.AncillaryData
+func packetOptions(ci gopacket.CaptureInfo) []ngOption {
+	for _, a := range ci.AncillaryData {
+		if options, ok := a.([]ngOption); ok {
+			return options
+		}
+	}
+	return nil
+}
 
-		oldEthLayer := ethPacket.Layers()[0].(*layers.Ethernet)
+// annotate returns the frame of a packet with the trailer holding the
+// metadata of its process, or with --metadata options or darwin, the
+// untouched packet and the options holding the metadata. The frame is nil if
+// the packet isn't one of --process, or is tcpshark's own traffic. It's safe
+// to call from several goroutines
+func annotate(fragments *fragmentTable, linkType layers.LinkType, packet []byte, ci gopacket.CaptureInfo) ([]byte, []ngOption) {
+	decoded := gopacket.NewPacket(
+		packet,
+		linkType,
+		gopacket.Default,
+	)
 
-		// subtract oldethelayer from the begining of ethpacket
-		restOfLayers := ethPacket.Layers()[1:]
-		remainder := []byte{}
-		metadata := packetMetaData{}
-		for _, layer := range restOfLayers {
-			// we can correlate metadata only in TCP or UDP for now
-			remainder = append(remainder, layer.LayerContents()...)
-			if layer.LayerType() == layers.LayerTypeTCP {
-				tcpLayer := layer.(*layers.TCP)
-				metadata = lookupProcess(generalOptions.Verbosity, uint16(tcpLayer.SrcPort), uint16(tcpLayer.DstPort))
+	// subtract the link layer from the begining of the packet
+	restOfLayers := networkLayers(decoded)
+	// packets captured from a cgroup carry the cookie of their socket, others
+	// can only be correlated in transport layers with ports
+	cg, fromCgroup := cgroupOf(ci)
+	metadata, found := lookupCookie(generalOptions.Verbosity, cg.SocketCookie)
+	var inner *packetMetaData
+	if !found {
+		metadata, inner = attributeLayers(generalOptions.Verbosity, restOfLayers)
+		if fragmentMetadata, ok := fragments.attribute(generalOptions.Verbosity, decoded); ok {
+			metadata = fragmentMetadata
+		}
+	}
+	// packets captured from a cgroup belong to it even if no socket matched
+	if fromCgroup {
+		if metadata.Pid == 0 {
+			metadata = packetMetaData{
+				Magic:  tcpSharkMagic,
+				Cmd:    cg.CgroupName,
+				UID:    cg.UID,
+				Source: sourceCgroup,
 			}
-			if layer.LayerType() == layers.LayerTypeUDP {
-				udpLayer := layer.(*layers.UDP)
-				metadata = lookupProcess(generalOptions.Verbosity, uint16(udpLayer.SrcPort), uint16(udpLayer.DstPort))
+		}
+		metadata.Cookie = cg.SocketCookie
+		// the socket may be in a child of --cgroup, as reported by eBPF
+		if metadata.Cgroup == "" {
+			metadata.Cgroup = cg.CgroupName
+		}
+		if cg.Egress {
+			metadata.Direction = directionOutgoing
+		} else {
+			metadata.Direction = directionIncoming
+		}
+	}
+	if !generalOptions.TunnelInner {
+		inner = nil
+	}
+	if !processSelected(&metadata, inner) || ownTraffic(&metadata) {
+		return nil, nil
+	}
+	switch generalOptions.Metadata {
+	case "options":
+		return packet, metadataOptions(&metadata, inner)
+	case "darwin":
+		return packet, darwinProcesses.options(&metadata)
+	}
+	if generalOptions.Metadata == "inventory" {
+		for _, m := range []*packetMetaData{&metadata, inner} {
+			if m != nil {
+				m.Index = inventory.index(m)
 			}
 		}
-		var packetTrailer bytes.Buffer
-		err = struc.Pack(&packetTrailer, &metadata)
-		if err != nil {
-			log.Warn().Msg(err.Error())
+	}
+	trailer := packTrailer(&metadata, inner)
+	oldEthLayer, ethernet := decoded.LinkLayer().(*layers.Ethernet)
+	if generalOptions.Passthrough {
+		return passthroughFrame(packet, ethernet, ci.CaptureLength < ci.Length, trailer), nil
+	}
+	var frame []byte
+	if ethernet {
+		remainder := []byte{}
+		for _, layer := range restOfLayers {
+			remainder = append(remainder, layer.LayerContents()...)
 		}
 		newEtherLayer := &EthernetWithTrailer{
 			SrcMAC:       oldEthLayer.SrcMAC,
 			DstMAC:       oldEthLayer.DstMAC,
 			EthernetType: oldEthLayer.EthernetType,
-			Trailer:      packetTrailer.Bytes(),
+			Trailer:      trailer,
 		}
 
 		buffer := gopacket.NewSerializeBuffer()
-		err = gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{}, newEtherLayer, gopacket.Payload(remainder))
+		if err := gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{}, newEtherLayer, gopacket.Payload(remainder)); err != nil {
+			log.Warn().Msg(err.Error())
+		}
+		frame = buffer.Bytes()
+	} else {
+		frame = frameWithTrailer(decoded, trailer)
+	}
+	return frame, nil
+}
+
+// blocking function to grab packets
+func capture() {
+	// set up inpput handle
+	var output io.Writer
+	if generalOptions.OutFile == "-" {
+		output = os.Stdout
+	} else {
+		f, err := os.OpenFile(string(generalOptions.OutFile), os.O_RDWR|os.O_CREATE, 0o755)
 		if err != nil {
 			log.Warn().Msg(err.Error())
 		}
+		defer f.Close()
+		output = f
+	}
+	ng, err := newNgWriter(output)
+	if err != nil {
+		log.Fatal().Msg(err.Error())
+	}
+	out := &captureOutput{ng: ng}
+	if procEvents != nil {
+		go writeProcEvents(out.ng)
+	}
+	fragments := newFragmentTable(generalOptions.FragmentTimeout)
+	var inputHandle gopacket.PacketDataSource
+	// interfaces are annotated by the goroutines reading them
+	annotated := false
+	offline := generalOptions.ReadFile != ""
+	if offline || generalOptions.Cgroup != "" {
+		var source packetSource
+		name := generalOptions.Cgroup
+		if offline {
+			name = string(generalOptions.ReadFile)
+			source = initializeOfflinePcap(name, generalOptions.Bpf)
+		} else {
+			source = initializeCgroupCapture(name, generalOptions.Bpf)
+		}
+		if _, err := out.addInterface(name, source, ""); err != nil {
+			log.Fatal().Msg(err.Error())
+		}
+		inputHandle = source
+	} else {
+		inputHandle = newMergedSource(generalOptions.Interface, generalOptions.Bpf, out, fragments)
+		annotated = true
+	}
+
+	for {
+		packet, ci, err := inputHandle.ReadPacketData()
+		if offline && err == io.EOF {
+			log.Info().Msg("Reached the end of the input file")
+			return
+		}
+		if err != nil {
+			log.Fatal().Msg(err.Error())
+		}
+		if replay != nil {
+			replay.advance(ci.Timestamp)
+		}
 
-		err = outputHandle.WritePacket(gopacket.CaptureInfo{
-			Timestamp:     time.Now(),
-			Length:        len(buffer.Bytes()),
-			CaptureLength: len(buffer.Bytes()),
-		}, buffer.Bytes())
+		frame, options := packet, packetOptions(ci)
+		if !annotated {
+			frame, options = annotate(fragments, out.linkTypes[ci.InterfaceIndex], packet, ci)
+			if frame == nil {
+				continue
+			}
+		}
+		darwinProcesses.write(out.ng)
+		inventory.write(out, ci.Timestamp)
+
+		// truncated packets keep the bytes they miss in their length, so the
+		// dissector can tell where the trailer is
+		length := len(frame)
+		if ci.Length > ci.CaptureLength {
+			length += ci.Length - ci.CaptureLength
+		}
+		// packets keep the timestamp of their source, so the packets of all
+		// interfaces are in order, and annotated files keep their original
+		// timestamps
+		err = out.ng.writePacket(gopacket.CaptureInfo{
+			Timestamp:      ci.Timestamp,
+			InterfaceIndex: ci.InterfaceIndex,
+			Length:         length,
+			CaptureLength:  len(frame),
+		}, frame, options)
 		if err != nil {
 			panic(err)
 		}
-		outputHandle.Flush()
+		out.ng.flush()
 
 	}
 }
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/link"
+	"github.com/cilium/ebpf/perf"
+	"github.com/cilium/ebpf/rlimit"
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/gopacket/gopacket/pcap"
+	"github.com/rs/zerolog/log"
+)
+
+// the header written by the cgroup_skb programs in front of each packet
+//
+//	0  u32 skb length
+//	4  u32 ifindex
+//	8  u64 socket cookie
+//	16 u32 socket uid
+//	20 u16 ethertype, network order
+//	22 u8  direction
+const (
+	cgroupHeaderSize   = 24
+	cgroupHeaderOffset = -cgroupHeaderSize
+
+	// cgroupSnapLen is the most that can be copied, --snaplen may be lower
+	cgroupSnapLen = 65536
+
+	// offsets in struct __sk_buff
+	skbLen      = 0
+	skbProtocol = 16
+	skbIfindex  = 40
+)
+
+// cgroupSource reads the packets streamed by the cgroup_skb programs attached
+// to a cgroup. It implements gopacket.PacketDataSource
+type cgroupSource struct {
+	reader  *perf.Reader
+	filter  *pcap.BPF
+	snapLen int
+	id      uint64
+	name    string
+	links   []link.Link
+}
+
+// cgroupSKBProgram copies up to snapLen bytes of each packet, starting at the
+// network header, to events. Packets are always let through
+func cgroupSKBProgram(events *ebpf.Map, egress bool, snapLen int) asm.Instructions {
+	direction := int64(0)
+	if egress {
+		direction = 1
+	}
+	return asm.Instructions{
+		asm.Mov.Reg(asm.R6, asm.R1),
+		asm.StoreImm(asm.RFP, cgroupHeaderOffset, 0, asm.DWord),
+		asm.StoreImm(asm.RFP, cgroupHeaderOffset+8, 0, asm.DWord),
+		asm.StoreImm(asm.RFP, cgroupHeaderOffset+16, 0, asm.DWord),
+		asm.LoadMem(asm.R2, asm.R6, skbLen, asm.Word),
+		asm.StoreMem(asm.RFP, cgroupHeaderOffset, asm.R2, asm.Word),
+		asm.LoadMem(asm.R2, asm.R6, skbIfindex, asm.Word),
+		asm.StoreMem(asm.RFP, cgroupHeaderOffset+4, asm.R2, asm.Word),
+		asm.Mov.Reg(asm.R1, asm.R6),
+		asm.FnGetSocketCookie.Call(),
+		asm.StoreMem(asm.RFP, cgroupHeaderOffset+8, asm.R0, asm.DWord),
+		asm.Mov.Reg(asm.R1, asm.R6),
+		asm.FnGetSocketUid.Call(),
+		asm.StoreMem(asm.RFP, cgroupHeaderOffset+16, asm.R0, asm.Word),
+		asm.LoadMem(asm.R2, asm.R6, skbProtocol, asm.Word),
+		asm.StoreMem(asm.RFP, cgroupHeaderOffset+20, asm.R2, asm.Half),
+		asm.StoreImm(asm.RFP, cgroupHeaderOffset+22, direction, asm.Byte),
+
+		// the upper 32 bits of the flags are the number of packet bytes to
+		// append to the header
+		asm.LoadMem(asm.R3, asm.R6, skbLen, asm.Word),
+		asm.JLE.Imm(asm.R3, int32(snapLen), "flags"),
+		asm.Mov.Imm(asm.R3, int32(snapLen)),
+		asm.LSh.Imm(asm.R3, 32).WithSymbol("flags"),
+		asm.LoadImm(asm.R4, 0xffffffff, asm.DWord), // BPF_F_CURRENT_CPU
+		asm.Or.Reg(asm.R3, asm.R4),
+
+		asm.Mov.Reg(asm.R1, asm.R6),
+		asm.LoadMapPtr(asm.R2, events.FD()),
+		asm.Mov.Reg(asm.R4, asm.RFP),
+		asm.Add.Imm(asm.R4, cgroupHeaderOffset),
+		asm.Mov.Imm(asm.R5, cgroupHeaderSize),
+		asm.FnPerfEventOutput.Call(),
+		asm.Mov.Imm(asm.R0, 1),
+		asm.Return(),
+	}
+}
+
+// initializeCgroupCapture attaches cgroup_skb ingress and egress programs to
+// the cgroup v2 directory at path, such as a systemd unit or a pod, and
+// returns a source of its packets. The packets are given an Ethernet header
+// with zero MAC addresses
+func initializeCgroupCapture(path, filter string) packetSource {
+	if err := rlimit.RemoveMemlock(); err != nil {
+		log.Fatal().Msg(err.Error())
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		log.Fatal().Msg(err.Error())
+	}
+	// on cgroup v2, the id of a cgroup is the inode of its directory
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || !info.IsDir() {
+		log.Fatal().Msgf("%s is not a cgroup v2 directory", path)
+	}
+	source := &cgroupSource{
+		id:      st.Ino,
+		name:    filepath.Base(path),
+		snapLen: min(max(generalOptions.SnapLen, 1), cgroupSnapLen),
+	}
+
+	events, err := ebpf.NewMap(&ebpf.MapSpec{
+		Name: "tcpshark_cgroup",
+		Type: ebpf.PerfEventArray,
+	})
+	if err != nil {
+		log.Fatal().Msg(err.Error())
+	}
+	for _, attach := range []ebpf.AttachType{ebpf.AttachCGroupInetIngress, ebpf.AttachCGroupInetEgress} {
+		prog, err := ebpf.NewProgram(&ebpf.ProgramSpec{
+			Name:         "tcpshark_cgroup",
+			Type:         ebpf.CGroupSKB,
+			AttachType:   attach,
+			Instructions: cgroupSKBProgram(events, attach == ebpf.AttachCGroupInetEgress, source.snapLen),
+			License:      "GPL",
+		})
+		if err != nil {
+			log.Fatal().Msg(err.Error())
+		}
+		l, err := link.AttachCgroup(link.CgroupOptions{
+			Path:    path,
+			Attach:  attach,
+			Program: prog,
+		})
+		if err != nil {
+			log.Fatal().Msg(err.Error())
+		}
+		source.links = append(source.links, l)
+	}
+
+	source.reader, err = perf.NewReader(events, os.Getpagesize()*256)
+	if err != nil {
+		log.Fatal().Msg(err.Error())
+	}
+	if filter != "" {
+		source.filter, err = pcap.NewBPF(layers.LinkTypeEthernet, 14+source.snapLen, filter)
+		if err != nil {
+			log.Fatal().Msg(err.Error())
+		}
+	}
+	log.Info().Msgf("Using cgroup: %s (id %d)", path, source.id)
+	log.Info().Msgf("Filter: %s", filter)
+	return source
+}
+
+// LinkType is always Ethernet, the packets are given a zero Ethernet header
+func (c *cgroupSource) LinkType() layers.LinkType {
+	return layers.LinkTypeEthernet
+}
+
+// ReadPacketData returns the next packet of the cgroup
+func (c *cgroupSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	for {
+		record, err := c.reader.Read()
+		if err != nil {
+			return nil, gopacket.CaptureInfo{}, err
+		}
+		if record.LostSamples > 0 {
+			log.Warn().Msgf("lost %d packets of the cgroup", record.LostSamples)
+			continue
+		}
+		sample := record.RawSample
+		if len(sample) < cgroupHeaderSize {
+			continue
+		}
+		length := int(binary.NativeEndian.Uint32(sample[0:4]))
+		captureLength := min(length, c.snapLen, len(sample)-cgroupHeaderSize)
+
+		// the samples may have a few bytes of trailing garbage, only the
+		// length reported by the program is used
+		frame := make([]byte, 14+captureLength)
+		copy(frame[12:14], sample[20:22])
+		copy(frame[14:], sample[cgroupHeaderSize:cgroupHeaderSize+captureLength])
+		ci := gopacket.CaptureInfo{
+			Timestamp:     time.Now(),
+			CaptureLength: len(frame),
+			Length:        14 + length,
+			AncillaryData: []interface{}{cgroupPacket{
+				CgroupID:     c.id,
+				CgroupName:   c.name,
+				SocketCookie: binary.NativeEndian.Uint64(sample[8:16]),
+				UID:          binary.NativeEndian.Uint32(sample[16:20]),
+				Ifindex:      binary.NativeEndian.Uint32(sample[4:8]),
+				Egress:       sample[22] == 1,
+			}},
+		}
+		if c.filter != nil && !c.filter.Matches(ci, frame) {
+			continue
+		}
+		return frame, ci, nil
+	}
+}
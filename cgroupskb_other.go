@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "github.com/rs/zerolog/log"
+
+func initializeCgroupCapture(path, filter string) packetSource {
+	log.Fatal().Msg("cgroup capture is only supported on Linux")
+	return nil
+}
@@ -0,0 +1,573 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/btf"
+	"github.com/cilium/ebpf/link"
+	"github.com/cilium/ebpf/perf"
+	"github.com/cilium/ebpf/rlimit"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/rs/zerolog/log"
+)
+
+// the event written by the eBPF programs to the perf event array. It lives at
+// the bottom of the program stack
+//
+//	0  u64 pid_tgid
+//	8  u64 cgroup id
+//	16 char comm[16]
+//	32 u16 local port, host order
+//	34 u16 remote port, network order
+//	36 u8  ip protocol
+//	37 u8  event kind
+//	40 u64 socket cookie, 0 if unknown
+const (
+	bpfEventSize   = 48
+	bpfEventOffset = -bpfEventSize
+	bpfScratch     = bpfEventOffset - 8
+
+	bpfEventOpen  = 0
+	bpfEventClose = 1
+
+	// tcpClose is TCP_CLOSE in the kernel socket states
+	tcpClose = 7
+)
+
+const (
+	// bpfCloseGrace is how long a closed socket is kept, so the last packets
+	// of the connection are still attributed
+	bpfCloseGrace = 5 * time.Second
+	// bpfUDPTimeout is how long a UDP socket is kept after its last send,
+	// since there's no close event for them
+	bpfUDPTimeout = time.Minute
+)
+
+// bpfTCPTimeout is how long a TCP socket is kept without a close event, in
+// case the event was lost. It's bpfUDPTimeout when the close events are not
+// tracked at all. Longer lived connections are in the polled socket tables
+var bpfTCPTimeout = time.Hour
+
+// bpfLinks keeps the attached programs alive for the lifetime of the process
+var bpfLinks []link.Link
+
+// bpfOffsets are the offsets of the kernel struct members read by the programs
+type bpfOffsets struct {
+	skcNum, skcDport int32
+	msgName          int32
+	acceptArgs       int
+}
+
+// bpfMember returns the byte offset of member in the struct typeName,
+// looking through anonymous structs and unions
+func bpfMember(spec *btf.Spec, typeName, member string) (int32, error) {
+	var s *btf.Struct
+	if err := spec.TypeByName(typeName, &s); err != nil {
+		return 0, err
+	}
+	off, ok := findBTFMember(s.Members, member)
+	if !ok {
+		return 0, fmt.Errorf("member %s not found in struct %s", member, typeName)
+	}
+	return int32(off.Bytes()), nil
+}
+
+func findBTFMember(members []btf.Member, name string) (btf.Bits, bool) {
+	for _, m := range members {
+		if m.Name == name {
+			return m.Offset, true
+		}
+		if m.Name != "" {
+			continue
+		}
+		var inner []btf.Member
+		switch t := btf.UnderlyingType(m.Type).(type) {
+		case *btf.Struct:
+			inner = t.Members
+		case *btf.Union:
+			inner = t.Members
+		}
+		if off, ok := findBTFMember(inner, name); ok {
+			return m.Offset + off, true
+		}
+	}
+	return 0, false
+}
+
+func loadBPFOffsets() (o bpfOffsets, err error) {
+	spec, err := btf.LoadKernelSpec()
+	if err != nil {
+		return o, err
+	}
+	if o.skcNum, err = bpfMember(spec, "sock_common", "skc_num"); err != nil {
+		return o, err
+	}
+	if o.skcDport, err = bpfMember(spec, "sock_common", "skc_dport"); err != nil {
+		return o, err
+	}
+	if o.msgName, err = bpfMember(spec, "msghdr", "msg_name"); err != nil {
+		return o, err
+	}
+	// the signature of inet_csk_accept changed over time, and the return value
+	// of an fexit program comes right after the arguments
+	var fn *btf.Func
+	if err = spec.TypeByName("inet_csk_accept", &fn); err != nil {
+		return o, err
+	}
+	proto, ok := fn.Type.(*btf.FuncProto)
+	if !ok {
+		return o, errors.New("inet_csk_accept has no prototype")
+	}
+	o.acceptArgs = len(proto.Params)
+	return o, nil
+}
+
+// tracepointField is the location of a field in a tracepoint record
+type tracepointField struct {
+	offset int16
+	size   asm.Size
+}
+
+// loadTracepointFormat parses the format file of a tracepoint and returns its
+// fields by name
+func loadTracepointFormat(group, name string) (map[string]tracepointField, error) {
+	var f *os.File
+	var err error
+	for _, tracefs := range []string{"/sys/kernel/tracing", "/sys/kernel/debug/tracing"} {
+		f, err = os.Open(tracefs + "/events/" + group + "/" + name + "/format")
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// field:__u16 sport;	offset:24;	size:2;	signed:0;
+	fields := make(map[string]tracepointField)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if !strings.HasPrefix(line, "field:") {
+			continue
+		}
+		parts := strings.Split(line, ";")
+		if len(parts) < 3 {
+			continue
+		}
+		decl := strings.Fields(strings.TrimPrefix(parts[0], "field:"))
+		if len(decl) == 0 {
+			continue
+		}
+		fieldName := decl[len(decl)-1]
+		offset, err := strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(parts[1]), "offset:"))
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(parts[2]), "size:"))
+		if err != nil {
+			return nil, err
+		}
+		field := tracepointField{offset: int16(offset)}
+		switch size {
+		case 1:
+			field.size = asm.Byte
+		case 2:
+			field.size = asm.Half
+		case 4:
+			field.size = asm.Word
+		case 8:
+			field.size = asm.DWord
+		default:
+			continue
+		}
+		fields[fieldName] = field
+	}
+	return fields, sc.Err()
+}
+
+// bpfEventZero zeroes the event on the stack
+func bpfEventZero() asm.Instructions {
+	insns := asm.Instructions{}
+	for off := int16(bpfEventOffset); off < 0; off += 8 {
+		insns = append(insns, asm.StoreImm(asm.RFP, off, 0, asm.DWord))
+	}
+	return insns
+}
+
+// bpfEventInit zeroes the event and fills in the protocol and the current task
+func bpfEventInit(protocol int64) asm.Instructions {
+	return append(bpfEventZero(),
+		asm.StoreImm(asm.RFP, bpfEventOffset+36, protocol, asm.Byte),
+		asm.FnGetCurrentPidTgid.Call(),
+		asm.StoreMem(asm.RFP, bpfEventOffset, asm.R0, asm.DWord),
+		asm.FnGetCurrentCgroupId.Call(),
+		asm.StoreMem(asm.RFP, bpfEventOffset+8, asm.R0, asm.DWord),
+		asm.Mov.Reg(asm.R1, asm.RFP),
+		asm.Add.Imm(asm.R1, bpfEventOffset+16),
+		asm.Mov.Imm(asm.R2, 16),
+		asm.FnGetCurrentComm.Call(),
+	)
+}
+
+// bpfReadKernel copies size bytes at src+offset to the stack at dst
+func bpfReadKernel(dst int32, size int32, src asm.Register, offset int32) asm.Instructions {
+	return asm.Instructions{
+		asm.Mov.Reg(asm.R1, asm.RFP),
+		asm.Add.Imm(asm.R1, dst),
+		asm.Mov.Imm(asm.R2, size),
+		asm.Mov.Reg(asm.R3, src),
+		asm.Add.Imm(asm.R3, offset),
+		asm.FnProbeReadKernel.Call(),
+	}
+}
+
+// bpfSockPorts reads the ports of the struct sock in R7 into the event
+func bpfSockPorts(o bpfOffsets) asm.Instructions {
+	insns := bpfReadKernel(bpfEventOffset+32, 2, asm.R7, o.skcNum)
+	return append(insns, bpfReadKernel(bpfEventOffset+34, 2, asm.R7, o.skcDport)...)
+}
+
+// bpfSockCookie reads the cookie of the struct sock in R7 into the event, if
+// the kernel lets tracing programs read it
+func bpfSockCookie(cookie bool) asm.Instructions {
+	if !cookie {
+		return nil
+	}
+	return asm.Instructions{
+		asm.Mov.Reg(asm.R1, asm.R7),
+		asm.FnGetSocketCookie.Call(),
+		asm.StoreMem(asm.RFP, bpfEventOffset+40, asm.R0, asm.DWord),
+	}
+}
+
+// bpfEventOutput tags the event with its kind, writes it to events and exits.
+// The context must be in R6
+func bpfEventOutput(events *ebpf.Map, kind int64) asm.Instructions {
+	return asm.Instructions{
+		asm.StoreImm(asm.RFP, bpfEventOffset+37, kind, asm.Byte).WithSymbol("output"),
+		asm.Mov.Reg(asm.R1, asm.R6),
+		asm.LoadMapPtr(asm.R2, events.FD()),
+		asm.LoadImm(asm.R3, 0xffffffff, asm.DWord), // BPF_F_CURRENT_CPU
+		asm.Mov.Reg(asm.R4, asm.RFP),
+		asm.Add.Imm(asm.R4, bpfEventOffset),
+		asm.Mov.Imm(asm.R5, bpfEventSize),
+		asm.FnPerfEventOutput.Call(),
+		asm.Mov.Imm(asm.R0, 0).WithSymbol("exit"),
+		asm.Return(),
+	}
+}
+
+// bpfConnectProgram reports the socket passed as the first argument of an
+// fentry program, like tcp_connect
+func bpfConnectProgram(o bpfOffsets, events *ebpf.Map, cookie bool) asm.Instructions {
+	insns := asm.Instructions{
+		asm.Mov.Reg(asm.R6, asm.R1),
+		asm.LoadMem(asm.R7, asm.R6, 0, asm.DWord),
+	}
+	insns = append(insns, bpfEventInit(6)...)
+	insns = append(insns, bpfSockPorts(o)...)
+	insns = append(insns, bpfSockCookie(cookie)...)
+	return append(insns, bpfEventOutput(events, bpfEventOpen)...)
+}
+
+// bpfAcceptProgram reports the socket returned by inet_csk_accept
+func bpfAcceptProgram(o bpfOffsets, events *ebpf.Map, cookie bool) asm.Instructions {
+	insns := asm.Instructions{
+		asm.Mov.Reg(asm.R6, asm.R1),
+		asm.LoadMem(asm.R7, asm.R6, int16(8*o.acceptArgs), asm.DWord),
+		asm.JEq.Imm(asm.R7, 0, "exit"),
+	}
+	insns = append(insns, bpfEventInit(6)...)
+	insns = append(insns, bpfSockPorts(o)...)
+	insns = append(insns, bpfSockCookie(cookie)...)
+	return append(insns, bpfEventOutput(events, bpfEventOpen)...)
+}
+
+// bpfSendmsgProgram reports the socket of udp_sendmsg and udpv6_sendmsg, once
+// they return so the local port of a socket sending for the first time is
+// bound. The remote port of unconnected sockets is taken from msg->msg_name
+func bpfSendmsgProgram(o bpfOffsets, events *ebpf.Map, cookie bool) asm.Instructions {
+	insns := asm.Instructions{
+		asm.Mov.Reg(asm.R6, asm.R1),
+		asm.LoadMem(asm.R7, asm.R6, 0, asm.DWord),
+		asm.LoadMem(asm.R8, asm.R6, 8, asm.DWord),
+	}
+	insns = append(insns, bpfEventInit(17)...)
+	insns = append(insns, bpfSockPorts(o)...)
+	insns = append(insns, bpfSockCookie(cookie)...)
+	insns = append(insns, bpfReadKernel(bpfScratch, 8, asm.R8, o.msgName)...)
+	insns = append(insns,
+		asm.LoadMem(asm.R9, asm.RFP, bpfScratch, asm.DWord),
+		asm.JEq.Imm(asm.R9, 0, "output"),
+	)
+	// sin_port and sin6_port both sit right after the address family
+	insns = append(insns, bpfReadKernel(bpfEventOffset+34, 2, asm.R9, 2)...)
+	return append(insns, bpfEventOutput(events, bpfEventOpen)...)
+}
+
+// bpfCloseProgram reports the sockets moving to TCP_CLOSE from the
+// sock:inet_sock_set_state tracepoint. It runs in any context, so there's no
+// task information
+func bpfCloseProgram(fields map[string]tracepointField, events *ebpf.Map) (asm.Instructions, error) {
+	for _, name := range []string{"newstate", "sport", "dport", "protocol"} {
+		if _, ok := fields[name]; !ok {
+			return nil, fmt.Errorf("field %s missing from sock:inet_sock_set_state", name)
+		}
+	}
+	insns := asm.Instructions{
+		asm.Mov.Reg(asm.R6, asm.R1),
+		asm.LoadMem(asm.R2, asm.R6, fields["newstate"].offset, fields["newstate"].size),
+		asm.JNE.Imm(asm.R2, tcpClose, "exit"),
+	}
+	insns = append(insns, bpfEventZero()...)
+	insns = append(insns,
+		asm.LoadMem(asm.R2, asm.R6, fields["sport"].offset, fields["sport"].size),
+		asm.StoreMem(asm.RFP, bpfEventOffset+32, asm.R2, asm.Half),
+		asm.LoadMem(asm.R2, asm.R6, fields["dport"].offset, fields["dport"].size),
+		asm.HostTo(asm.BE, asm.R2, asm.Half),
+		asm.StoreMem(asm.RFP, bpfEventOffset+34, asm.R2, asm.Half),
+		asm.LoadMem(asm.R2, asm.R6, fields["protocol"].offset, fields["protocol"].size),
+		asm.StoreMem(asm.RFP, bpfEventOffset+36, asm.R2, asm.Byte),
+	)
+	return append(insns, bpfEventOutput(events, bpfEventClose)...), nil
+}
+
+// startBPFAttribution loads and attaches the eBPF programs reporting socket
+// creation and teardown, and streams their events into bpfProcessLookup
+func startBPFAttribution() error {
+	if err := rlimit.RemoveMemlock(); err != nil {
+		return err
+	}
+	offsets, err := loadBPFOffsets()
+	if err != nil {
+		return err
+	}
+	events, err := ebpf.NewMap(&ebpf.MapSpec{
+		Name: "tcpshark_events",
+		Type: ebpf.PerfEventArray,
+	})
+	if err != nil {
+		return err
+	}
+
+	tracing := []struct {
+		attachTo   string
+		attachType ebpf.AttachType
+		program    func(bpfOffsets, *ebpf.Map, bool) asm.Instructions
+	}{
+		{"tcp_connect", ebpf.AttachTraceFEntry, bpfConnectProgram},
+		{"inet_csk_accept", ebpf.AttachTraceFExit, bpfAcceptProgram},
+		{"udp_sendmsg", ebpf.AttachTraceFExit, bpfSendmsgProgram},
+		{"udpv6_sendmsg", ebpf.AttachTraceFExit, bpfSendmsgProgram},
+	}
+	for _, t := range tracing {
+		spec := &ebpf.ProgramSpec{
+			Name:         "tcpshark_" + t.attachTo,
+			Type:         ebpf.Tracing,
+			AttachType:   t.attachType,
+			AttachTo:     t.attachTo,
+			Instructions: t.program(offsets, events, true),
+			License:      "GPL",
+		}
+		prog, err := ebpf.NewProgram(spec)
+		if err != nil {
+			// tracing programs can read socket cookies since Linux 5.12
+			spec.Instructions = t.program(offsets, events, false)
+			prog, err = ebpf.NewProgram(spec)
+		}
+		if err != nil {
+			log.Warn().Msgf("could not load eBPF program for %s: %s", t.attachTo, err)
+			continue
+		}
+		l, err := link.AttachTracing(link.TracingOptions{Program: prog})
+		if err != nil {
+			log.Warn().Msgf("could not attach eBPF program to %s: %s", t.attachTo, err)
+			continue
+		}
+		bpfLinks = append(bpfLinks, l)
+	}
+	if len(bpfLinks) == 0 {
+		events.Close()
+		return errors.New("none of the eBPF programs could be attached")
+	}
+
+	fields, err := loadTracepointFormat("sock", "inet_sock_set_state")
+	if err == nil {
+		var insns asm.Instructions
+		insns, err = bpfCloseProgram(fields, events)
+		if err == nil {
+			var prog *ebpf.Program
+			prog, err = ebpf.NewProgram(&ebpf.ProgramSpec{
+				Name:         "tcpshark_close",
+				Type:         ebpf.TracePoint,
+				Instructions: insns,
+				License:      "GPL",
+			})
+			if err == nil {
+				var l link.Link
+				l, err = link.Tracepoint("sock", "inet_sock_set_state", prog, nil)
+				if err == nil {
+					bpfLinks = append(bpfLinks, l)
+				}
+			}
+		}
+	}
+	if err != nil {
+		log.Warn().Msgf("closed sockets won't be tracked with eBPF: %s", err)
+		bpfTCPTimeout = bpfUDPTimeout
+	}
+
+	rd, err := perf.NewReader(events, os.Getpagesize()*64)
+	if err != nil {
+		return err
+	}
+	log.Info().Msgf("Attached %d eBPF programs for process attribution", len(bpfLinks))
+	go readBPFEvents(rd)
+	return nil
+}
+
+func readBPFEvents(rd *perf.Reader) {
+	for {
+		record, err := rd.Read()
+		if err != nil {
+			if errors.Is(err, perf.ErrClosed) {
+				return
+			}
+			log.Warn().Msg(err.Error())
+			continue
+		}
+		if record.LostSamples > 0 {
+			log.Warn().Msgf("lost %d eBPF socket events", record.LostSamples)
+			continue
+		}
+		handleBPFEvent(record.RawSample)
+	}
+}
+
+func handleBPFEvent(b []byte) {
+	if len(b) < bpfEventSize {
+		return
+	}
+	key := bpfSocketKey{
+		Protocol: layers.IPProtocol(b[36]),
+		packetMetaDataKey: packetMetaDataKey{
+			LocalPort:  binary.NativeEndian.Uint16(b[32:34]),
+			RemotePort: binary.BigEndian.Uint16(b[34:36]),
+		},
+	}
+	// a send that failed before binding the socket
+	if key.LocalPort == 0 {
+		return
+	}
+	now := time.Now()
+
+	processLookupLock.Lock()
+	defer processLookupLock.Unlock()
+	if b[37] == bpfEventClose {
+		if s, ok := bpfProcessLookup[key]; ok {
+			s.expires = now.Add(bpfCloseGrace)
+			bpfProcessLookup[key] = s
+		}
+		return
+	}
+	if s, ok := bpfProcessLookup[key]; ok && bpfCookies[s.cookie] == key {
+		delete(bpfCookies, s.cookie)
+	}
+	pidTgid := binary.NativeEndian.Uint64(b[0:8])
+	comm := b[16:32]
+	if i := bytes.IndexByte(comm, 0); i >= 0 {
+		comm = comm[:i]
+	}
+	s := bpfSocket{
+		metadata: packetMetaData{
+			Magic: tcpSharkMagic,
+			Pid:   uint32(pidTgid >> 32),
+			Cmd:   string(comm),
+		},
+		tid:     uint32(pidTgid),
+		cookie:  binary.NativeEndian.Uint64(b[40:48]),
+		expires: now.Add(bpfTCPTimeout),
+	}
+	cgroup := binary.NativeEndian.Uint64(b[8:16])
+	s.metadata.Cgroup = cgroupPath(cgroup, s.metadata.Pid)
+	if key.Protocol == layers.IPProtocolUDP {
+		s.expires = now.Add(bpfUDPTimeout)
+	}
+	bpfProcessLookup[key] = s
+	if s.cookie != 0 {
+		bpfCookies[s.cookie] = key
+	}
+	log.Debug().Msgf("eBPF: %d/%s (tid %d, cgroup %s) owns %d->%d", s.metadata.Pid, s.metadata.Cmd, s.tid, s.metadata.Cgroup, key.LocalPort, key.RemotePort)
+}
+
+// cgroupRoot is where the cgroup v2 hierarchy is mounted
+const cgroupRoot = "/sys/fs/cgroup"
+
+// cgroupPaths caches the path of the cgroups by id, relative to cgroupRoot as
+// in /proc/<pid>/cgroup. It's only used by the goroutine reading the events
+var cgroupPaths = struct {
+	paths    map[uint64]string
+	lastWalk time.Time
+}{paths: make(map[uint64]string)}
+
+// cgroupPath returns the path of the cgroup v2 with an id, the inode of its
+// directory. It's looked up from the cgroup of pid first, which is the one
+// of the event unless pid has moved or exited, then by walking cgroupRoot at
+// most once a second. It's empty if the cgroup isn't found
+func cgroupPath(id uint64, pid uint32) string {
+	if id == 0 {
+		return ""
+	}
+	if path, ok := cgroupPaths.paths[id]; ok {
+		return path
+	}
+	if path := processCgroup(pid); path != "" && cgroupID(filepath.Join(cgroupRoot, path)) == id {
+		cgroupPaths.paths[id] = path
+		return path
+	}
+	if time.Since(cgroupPaths.lastWalk) < time.Second {
+		return ""
+	}
+	cgroupPaths.lastWalk = time.Now()
+	// cgroups are removed with their units and pods, so the cache is rebuilt
+	paths := make(map[uint64]string)
+	filepath.WalkDir(cgroupRoot, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return nil
+		}
+		if rel, err := filepath.Rel(cgroupRoot, path); err == nil {
+			paths[cgroupID(path)] = filepath.Join("/", rel)
+		}
+		return nil
+	})
+	cgroupPaths.paths = paths
+	return paths[id]
+}
+
+// cgroupID returns the id of a cgroup v2 directory, 0 if it can't be read
+func cgroupID(dir string) uint64 {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return 0
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0
+	}
+	return st.Ino
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func startBPFAttribution() error {
+	return errors.New("eBPF attribution is only supported on Linux")
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gopacket/gopacket/pcap"
+	flags "github.com/jessevdk/go-flags"
+	"github.com/rs/zerolog/log"
+)
+
+// extcapPrefix starts the extcap interface names of tcpshark, followed by the
+// name of the captured interface
+const extcapPrefix = "tcpshark-"
+
+// extcapOptions are the flags Wireshark passes to extcap binaries
+var extcapOptions struct {
+	Interfaces    bool   `long:"extcap-interfaces"     description:"List the interfaces for Wireshark"`
+	Version       string `long:"extcap-version"        description:"Version of Wireshark"`
+	DLTs          bool   `long:"extcap-dlts"           description:"List the link types of --extcap-interface"`
+	Interface     string `long:"extcap-interface"      description:"Interface to query or capture"`
+	Config        bool   `long:"extcap-config"         description:"List the capture options of --extcap-interface"`
+	Capture       bool   `long:"capture"               description:"Capture --extcap-interface to --fifo"`
+	Fifo          string `long:"fifo"                  description:"Fifo the capture is written to"`
+	CaptureFilter string `long:"extcap-capture-filter" description:"Capture filter of Wireshark"`
+}
+
+// extcapQuery answers the queries of Wireshark about the extcap interfaces,
+// and returns false if it's not one
+func extcapQuery() bool {
+	switch {
+	case extcapOptions.Interfaces:
+		fmt.Println("extcap {version=1.0}{help=https://github.com/mosajjal/tcpshark}")
+		devs, err := pcap.FindAllDevs()
+		if err != nil {
+			log.Fatal().Msg(err.Error())
+		}
+		for _, dev := range devs {
+			display := "tcpshark: " + dev.Name
+			if dev.Description != "" {
+				display += " (" + dev.Description + ")"
+			}
+			fmt.Printf("interface {value=%s%s}{display=%s}\n", extcapPrefix, dev.Name, display)
+		}
+	case extcapOptions.DLTs:
+		// the links types of the interfaces are in the pcapng output
+		fmt.Println("dlt {number=1}{name=EN10MB}{display=Ethernet with tcpshark trailer}")
+	case extcapOptions.Config:
+		args := []string{
+			"arg {number=0}{call=--verbosity}{display=Metadata}{type=selector}{tooltip=Metadata of the processes in the trailer}",
+			"value {arg=0}{value=0}{display=pid}",
+			"value {arg=0}{value=1}{display=pid and command}{default=true}",
+			"value {arg=0}{value=2}{display=pid, command and arguments}",
+			"arg {number=1}{call=--process}{display=Processes}{type=string}{tooltip=Only capture the packets of these comma separated pids or commands}",
+			"arg {number=2}{call=--bpf}{display=BPF filter}{type=string}{tooltip=tcpdump-style BPF filter, applied along with the capture filter}",
+			"arg {number=3}{call=--metadata}{display=Metadata location}{type=selector}{tooltip=darwin is shown by Wireshark without tcpshark.lua}",
+			"value {arg=3}{value=trailer}{display=Frame trailer}{default=true}",
+			"value {arg=3}{value=options}{display=Packet comments}",
+			"value {arg=3}{value=darwin}{display=Process Information Blocks}",
+			"arg {number=4}{call=--tunnel-inner}{display=Attribute the inner flow of tunnels}{type=boolflag}",
+			"arg {number=5}{call=--ebpf}{display=Attribute short lived connections with eBPF}{type=boolflag}",
+		}
+		fmt.Println(strings.Join(args, "\n"))
+	default:
+		return false
+	}
+	return true
+}
+
+// setupExtcapCapture turns the capture flags passed by Wireshark into the ones
+// of tcpshark
+func setupExtcapCapture() {
+	if !extcapOptions.Capture {
+		return
+	}
+	name, ok := strings.CutPrefix(extcapOptions.Interface, extcapPrefix)
+	if !ok {
+		log.Fatal().Msgf("%s is not a tcpshark extcap interface", extcapOptions.Interface)
+	}
+	if extcapOptions.Fifo == "" {
+		log.Fatal().Msg("--capture needs --fifo")
+	}
+	generalOptions.Interface = []string{name}
+	generalOptions.OutFile = flags.Filename(extcapOptions.Fifo)
+	generalOptions.Bpf = andFilters(generalOptions.Bpf, extcapOptions.CaptureFilter)
+}
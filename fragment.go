@@ -0,0 +1,127 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+)
+
+// fragmentKey identifies all the fragments of a single IP datagram
+type fragmentKey struct {
+	Src, Dst [16]byte
+	Protocol layers.IPProtocol
+	ID       uint32
+}
+
+type fragmentEntry struct {
+	metadata packetMetaData
+	expires  time.Time
+}
+
+// fragmentTable remembers the attribution of the first fragment of each
+// datagram, so the following fragments, which carry no transport header, are
+// attributed to the same process. Entries are dropped once timeout has passed
+// since the first fragment was seen. Fragments arriving before the first one
+// are not attributed. It's safe for concurrent use
+type fragmentTable struct {
+	sync.Mutex
+	timeout   time.Duration
+	entries   map[fragmentKey]fragmentEntry
+	lastSweep time.Time
+}
+
+func newFragmentTable(timeout time.Duration) *fragmentTable {
+	return &fragmentTable{
+		timeout: timeout,
+		entries: make(map[fragmentKey]fragmentEntry),
+	}
+}
+
+// fragmentOf returns the fragment key, the fragment offset and the fragment
+// payload of packet. ok is false if the packet is not an IP fragment
+func fragmentOf(packet gopacket.Packet) (key fragmentKey, offset uint16, payload []byte, ok bool) {
+	if ip, isIPv4 := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4); isIPv4 {
+		if ip.Flags&layers.IPv4MoreFragments == 0 && ip.FragOffset == 0 {
+			return key, 0, nil, false
+		}
+		copy(key.Src[:], ip.SrcIP.To16())
+		copy(key.Dst[:], ip.DstIP.To16())
+		key.Protocol = ip.Protocol
+		key.ID = uint32(ip.Id)
+		return key, ip.FragOffset, ip.Payload, true
+	}
+	ip, isIPv6 := packet.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+	if !isIPv6 {
+		return key, 0, nil, false
+	}
+	frag, isFragment := packet.Layer(layers.LayerTypeIPv6Fragment).(*layers.IPv6Fragment)
+	if !isFragment {
+		return key, 0, nil, false
+	}
+	copy(key.Src[:], ip.SrcIP.To16())
+	copy(key.Dst[:], ip.DstIP.To16())
+	key.Protocol = frag.NextHeader
+	key.ID = frag.Identification
+	return key, frag.FragmentOffset, frag.Payload, true
+}
+
+// firstFragmentPorts decodes the transport header at the start of the first
+// fragment of a datagram. gopacket does not decode past the IP layer of a
+// fragment, even if the transport header is there.
+func firstFragmentPorts(protocol layers.IPProtocol, payload []byte) (srcPort, dstPort uint16, ok bool) {
+	if protocol == ipProtocolDCCP {
+		return dccpPorts(payload)
+	}
+	transport := gopacket.NewPacket(payload, protocol.LayerType(), gopacket.NoCopy)
+	for _, layer := range transport.Layers() {
+		if srcPort, dstPort, ok := transportPorts(layer); ok {
+			return srcPort, dstPort, true
+		}
+	}
+	return 0, 0, false
+}
+
+// attribute returns the metadata of packet if it is a fragment. The first
+// fragment is looked up by its ports and the result is stored for the rest of
+// the group. ok is false if the packet is not a fragment or its group is unknown
+func (t *fragmentTable) attribute(verbosity uint8, packet gopacket.Packet) (metadata packetMetaData, ok bool) {
+	key, offset, payload, isFragment := fragmentOf(packet)
+	if !isFragment {
+		return metadata, false
+	}
+	now := time.Now()
+	t.Lock()
+	defer t.Unlock()
+	t.sweep(now)
+	if offset != 0 {
+		entry, found := t.entries[key]
+		if !found || now.After(entry.expires) {
+			return metadata, false
+		}
+		metadata = entry.metadata
+		metadata.Source = sourceFragment
+		return metadata, true
+	}
+	srcPort, dstPort, found := firstFragmentPorts(key.Protocol, payload)
+	if !found {
+		return metadata, false
+	}
+	metadata = lookupProcess(verbosity, key.Protocol, srcPort, dstPort)
+	t.entries[key] = fragmentEntry{metadata: metadata, expires: now.Add(t.timeout)}
+	return metadata, true
+}
+
+// sweep drops the expired groups, at most once per timeout
+func (t *fragmentTable) sweep(now time.Time) {
+	if now.Sub(t.lastSweep) < t.timeout {
+		return
+	}
+	for key, entry := range t.entries {
+		if now.After(entry.expires) {
+			delete(t.entries, key)
+		}
+	}
+	t.lastSweep = now
+}
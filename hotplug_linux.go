@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// watchInterfaces sends the name of each interface created or changed to
+// added, as reported by rtnetlink
+func watchInterfaces(added chan<- string) error {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{
+		Family: unix.AF_NETLINK,
+		Groups: unix.RTMGRP_LINK,
+	}); err != nil {
+		unix.Close(fd)
+		return err
+	}
+	go readLinkEvents(fd, added)
+	return nil
+}
+
+func readLinkEvents(fd int, added chan<- string) {
+	defer unix.Close(fd)
+	buf := make([]byte, os.Getpagesize())
+	for {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if errors.Is(err, unix.EINTR) || errors.Is(err, unix.ENOBUFS) {
+			continue
+		}
+		if err != nil {
+			return
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			continue
+		}
+		for _, m := range msgs {
+			// an interface going away shows up as a capture error instead
+			if m.Header.Type != unix.RTM_NEWLINK {
+				continue
+			}
+			attrs, err := syscall.ParseNetlinkRouteAttr(&m)
+			if err != nil {
+				continue
+			}
+			for _, attr := range attrs {
+				if attr.Attr.Type == unix.IFLA_IFNAME {
+					added <- string(bytes.TrimRight(attr.Value, "\x00"))
+				}
+			}
+		}
+	}
+}
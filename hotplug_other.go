@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func watchInterfaces(added chan<- string) error {
+	return errors.New("interface events are only supported on Linux")
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/lunixbochs/struc"
+	"github.com/rs/zerolog/log"
+	"github.com/shirou/gopsutil/process"
+)
+
+// with --metadata inventory, the trailer of a packet only holds the index of
+// its process in the inventory. The inventory is written as inventoryRecord
+// packets of a dedicated interface, since Wireshark doesn't hand pcapng custom
+// blocks to dissectors
+const (
+	tcpSharkInventoryMagic = 0xA1BFF3D6
+	// linkTypeUser0 is DLT_USER0, the link type of the inventory interface
+	linkTypeUser0 layers.LinkType = 147
+)
+
+type inventoryEntry struct {
+	Index     uint32 `struc:"uint32"`
+	Pid       uint32 `struc:"uint32"`
+	StartTime int64  `struc:"int64"` // unix milliseconds, 0 if unknown
+	CmdLen    uint8  `struc:"uint8,sizeof=Cmd"`
+	Cmd       string
+	ArgsLen   uint16 `struc:"uint16,sizeof=Args"`
+	Args      string
+	UserLen   uint8 `struc:"uint8,sizeof=User"`
+	User      string
+	CgroupLen uint16 `struc:"uint16,sizeof=Cgroup"`
+	Cgroup    string
+}
+
+type inventoryRecord struct {
+	Magic      uint32 `struc:"uint32"`
+	Full       bool   `struc:"bool"` // the whole inventory rather than the new processes
+	EntriesLen uint32 `struc:"uint32,sizeof=Entries"`
+	Entries    []inventoryEntry
+}
+
+// inventoryKey identifies a process of the inventory. The command tells
+// processes apart when a pid is reused
+type inventoryKey struct {
+	pid uint32
+	cmd string
+}
+
+// processInventory numbers the processes seen in the packets. Indexes are
+// given while annotating, possibly from several goroutines, and the new
+// processes are written before the next packet
+type processInventory struct {
+	sync.Mutex
+	indexes map[inventoryKey]uint32
+	entries []inventoryEntry
+	pending []inventoryEntry
+	// interfaceIndex is the output interface of the inventory, -1 until the
+	// first record is written
+	interfaceIndex int
+	lastFull       time.Time
+}
+
+var inventory = &processInventory{indexes: make(map[inventoryKey]uint32), interfaceIndex: -1}
+
+// index returns the index of a packet's process in the inventory, adding the
+// process if it's new. It's 0 if the process is unknown
+func (t *processInventory) index(m *packetMetaData) uint32 {
+	if m.Magic != tcpSharkMagic || (m.Pid == 0 && m.Cmd == "") {
+		return 0
+	}
+	key := inventoryKey{m.Pid, m.Cmd}
+	t.Lock()
+	defer t.Unlock()
+	if index, ok := t.indexes[key]; ok {
+		return index
+	}
+	entry := inventoryEntry{
+		Index:  uint32(len(t.entries) + 1),
+		Pid:    m.Pid,
+		Cmd:    truncate(m.Cmd, 0xFF),
+		Args:   truncate(m.Args, 0xFFFF),
+		Cgroup: truncate(processCgroup(m.Pid), 0xFFFF),
+	}
+	if p, err := process.NewProcess(int32(m.Pid)); err == nil {
+		entry.StartTime, _ = p.CreateTime()
+		user, _ := p.Username()
+		entry.User = truncate(user, 0xFF)
+	}
+	t.indexes[key] = entry.Index
+	t.entries = append(t.entries, entry)
+	t.pending = append(t.pending, entry)
+	return entry.Index
+}
+
+// processCgroup returns the cgroup v2 path of a process, empty if it's unknown
+func processCgroup(pid uint32) string {
+	b, err := os.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if path, ok := strings.CutPrefix(line, "0::"); ok {
+			return path
+		}
+	}
+	return ""
+}
+
+// write writes the processes added since the previous call, or the whole
+// inventory every --inventory-interval, so a file cut short still has it. The
+// records are timestamped like the packet about to be written
+func (t *processInventory) write(out *captureOutput, ts time.Time) {
+	t.Lock()
+	record := inventoryRecord{Magic: tcpSharkInventoryMagic, Entries: t.pending}
+	if len(t.entries) > 0 && time.Since(t.lastFull) >= generalOptions.InventoryInterval {
+		record.Full = true
+		record.Entries = t.entries
+		t.lastFull = time.Now()
+	}
+	t.pending = nil
+	t.Unlock()
+	if len(record.Entries) == 0 {
+		return
+	}
+
+	if t.interfaceIndex < 0 {
+		id, err := out.ng.addInterface(ngInterface{name: "tcpshark processes", linkType: linkTypeUser0, tsresol: 9})
+		if err != nil {
+			log.Warn().Msg(err.Error())
+			return
+		}
+		out.linkTypes = append(out.linkTypes, linkTypeUser0)
+		t.interfaceIndex = id
+	}
+	var b bytes.Buffer
+	if err := struc.Pack(&b, &record); err != nil {
+		log.Warn().Msg(err.Error())
+		return
+	}
+	err := out.ng.writePacket(gopacket.CaptureInfo{
+		Timestamp:      ts,
+		InterfaceIndex: t.interfaceIndex,
+		Length:         b.Len(),
+		CaptureLength:  b.Len(),
+	}, b.Bytes(), nil)
+	if err != nil {
+		log.Warn().Msg(err.Error())
+	}
+}
+
+// truncate cuts s to at most n bytes
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/lunixbochs/struc"
+	"github.com/rs/zerolog/log"
+	"github.com/shirou/gopsutil/process"
+)
+
+// a journal starts with journalMagic and journalVersion, followed by one
+// journalRecord per reload of the process lookup table. Each record only holds
+// the changes since the previous one, so the first record is a full snapshot
+const (
+	journalMagic   = 0x54534B4A // TSKJ
+	journalVersion = 1
+)
+
+type journalHeader struct {
+	Magic   uint32 `struc:"uint32"`
+	Version uint8  `struc:"uint8"`
+}
+
+type journalEntry struct {
+	LocalPort  uint16 `struc:"uint16"`
+	RemotePort uint16 `struc:"uint16"`
+	Pid        uint32 `struc:"uint32"`
+	CmdLen     uint8  `struc:"uint8,sizeof=Cmd"`
+	Cmd        string
+	ArgsLen    uint16 `struc:"uint16,sizeof=Args"`
+	Args       string
+	Inode      uint64 `struc:"uint64"`
+}
+
+type journalRecord struct {
+	Timestamp  int64               `struc:"int64"` // unix nanoseconds
+	RemovedLen uint32              `struc:"uint32,sizeof=Removed"`
+	Removed    []packetMetaDataKey // sockets gone since the previous record
+	EntriesLen uint32              `struc:"uint32,sizeof=Entries"`
+	Entries    []journalEntry      // sockets added or changed since the previous record
+}
+
+// newJournalEntry returns the entry of a socket. struc doesn't check the
+// lengths, so the command and the arguments are cut to fit them rather than
+// wrap them, which would garble every following record
+func newJournalEntry(k packetMetaDataKey, m packetMetaData, args string) journalEntry {
+	return journalEntry{
+		LocalPort:  k.LocalPort,
+		RemotePort: k.RemotePort,
+		Pid:        m.Pid,
+		Cmd:        truncate(m.Cmd, 0xFF),
+		Args:       truncate(args, 0xFFFF),
+		Inode:      m.Inode,
+	}
+}
+
+// snapshotProcessLookup returns a copy of the process lookup table as used by
+// lookupProcess, with the eBPF sockets taking precedence
+func snapshotProcessLookup() map[packetMetaDataKey]packetMetaData {
+	processLookupLock.RLock()
+	defer processLookupLock.RUnlock()
+	snapshot := make(map[packetMetaDataKey]packetMetaData, len(globalProcessLookup)+len(bpfProcessLookup))
+	for k, m := range globalProcessLookup {
+		snapshot[k] = m
+	}
+	for k, s := range bpfProcessLookup {
+		snapshot[k.packetMetaDataKey] = s.metadata
+	}
+	return snapshot
+}
+
+// recordJournal reloads the process lookup table every second and appends the
+// changes to the journal at path. It never returns
+func recordJournal(path string) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		log.Fatal().Msg(err.Error())
+	}
+	if err := struc.Pack(f, &journalHeader{Magic: journalMagic, Version: journalVersion}); err != nil {
+		log.Fatal().Msg(err.Error())
+	}
+	log.Info().Msgf("Recording the process lookup table to %s", path)
+
+	previous := make(map[packetMetaDataKey]packetMetaData)
+	for {
+		reloadProcessLookup()
+		current := snapshotProcessLookup()
+		record := journalRecord{Timestamp: time.Now().UnixNano()}
+		for k := range previous {
+			if _, ok := current[k]; !ok {
+				record.Removed = append(record.Removed, k)
+			}
+		}
+		for k, m := range current {
+			if p, ok := previous[k]; ok && p.Pid == m.Pid && p.Cmd == m.Cmd && p.Inode == m.Inode {
+				continue
+			}
+			// the arguments are only read once per socket, while the process
+			// is still alive
+			proc, _ := process.NewProcess(int32(m.Pid))
+			args, _ := proc.Cmdline()
+			record.Entries = append(record.Entries, newJournalEntry(k, m, args))
+		}
+		var b bytes.Buffer
+		if err := struc.Pack(&b, &record); err != nil {
+			log.Fatal().Msg(err.Error())
+		}
+		if _, err := f.Write(b.Bytes()); err != nil {
+			log.Fatal().Msg(err.Error())
+		}
+		previous = current
+		time.Sleep(time.Second)
+	}
+}
+
+// journalReplay attributes packets with a recorded journal instead of the
+// live socket tables
+type journalReplay struct {
+	r *bufio.Reader
+	// next is the table as of nextTime, the time of the next record
+	next     map[packetMetaDataKey]packetMetaData
+	nextTime time.Time
+	eof      bool
+}
+
+// journalNextLookup is the table of the record following the packet being
+// processed. Sockets created between two reloads are only in the next record,
+// so it's used when globalProcessLookup has no match
+var journalNextLookup map[packetMetaDataKey]packetMetaData
+
+// replay is set when packets are attributed with --journal
+var replay *journalReplay
+
+func openJournal(path string) (*journalReplay, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	j := &journalReplay{
+		r:    bufio.NewReader(f),
+		next: make(map[packetMetaDataKey]packetMetaData),
+	}
+	var h journalHeader
+	if err := struc.Unpack(j.r, &h); err != nil {
+		return nil, err
+	}
+	if h.Magic != journalMagic || h.Version != journalVersion {
+		return nil, fmt.Errorf("%s is not a tcpshark journal", path)
+	}
+	if err := j.readRecord(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// readRecord applies the next record of the journal on top of j.next
+func (j *journalReplay) readRecord() error {
+	var record journalRecord
+	err := struc.Unpack(j.r, &record)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		// the last record may be cut short if the recorder was killed
+		j.eof = true
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	next := make(map[packetMetaDataKey]packetMetaData, len(j.next))
+	for k, m := range j.next {
+		next[k] = m
+	}
+	for _, k := range record.Removed {
+		delete(next, k)
+	}
+	for _, e := range record.Entries {
+		next[packetMetaDataKey{e.LocalPort, e.RemotePort}] = packetMetaData{
+			Magic: tcpSharkMagic,
+			Pid:   e.Pid,
+			Cmd:   e.Cmd,
+			Args:  e.Args,
+			Inode: e.Inode,
+		}
+	}
+	j.next = next
+	j.nextTime = time.Unix(0, record.Timestamp)
+	return nil
+}
+
+// advance makes the snapshot valid at ts the process lookup table
+func (j *journalReplay) advance(ts time.Time) {
+	changed := false
+	for !j.eof && !j.nextTime.After(ts) {
+		processLookupLock.Lock()
+		globalProcessLookup = j.next
+		processLookupLock.Unlock()
+		changed = true
+		if err := j.readRecord(); err != nil {
+			log.Warn().Msgf("stopped reading the journal: %s", err)
+			j.eof = true
+		}
+	}
+	if changed || (journalNextLookup == nil && !j.eof) {
+		processLookupLock.Lock()
+		journalNextLookup = j.next
+		if j.eof {
+			journalNextLookup = nil
+		}
+		processLookupLock.Unlock()
+	}
+}
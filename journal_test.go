@@ -0,0 +1,175 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lunixbochs/struc"
+)
+
+// writeJournal writes a journal made of records to a temporary file
+func writeJournal(t *testing.T, records []journalRecord) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "journal")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := struc.Pack(f, &journalHeader{Magic: journalMagic, Version: journalVersion}); err != nil {
+		t.Fatal(err)
+	}
+	for i := range records {
+		if err := struc.Pack(f, &records[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+// pids returns the pid of each socket of a lookup table
+func pids(lookup map[packetMetaDataKey]packetMetaData) map[packetMetaDataKey]uint32 {
+	if lookup == nil {
+		return nil
+	}
+	p := make(map[packetMetaDataKey]uint32, len(lookup))
+	for k, m := range lookup {
+		p[k] = m.Pid
+	}
+	return p
+}
+
+func TestJournalReplay(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	path := writeJournal(t, []journalRecord{
+		{
+			Timestamp: start.UnixNano(),
+			Entries: []journalEntry{
+				{LocalPort: 40000, RemotePort: 80, Pid: 10, Cmd: "curl", Args: "curl example.com", Inode: 100},
+				{LocalPort: 40001, RemotePort: 443, Pid: 20, Cmd: "wget", Inode: 200},
+			},
+		},
+		{
+			Timestamp: start.Add(time.Second).UnixNano(),
+			Removed:   []packetMetaDataKey{{40000, 80}},
+			Entries: []journalEntry{
+				{LocalPort: 40002, RemotePort: 53, Pid: 30, Cmd: "dig", Inode: 300},
+				// the socket of wget is now owned by its child
+				{LocalPort: 40001, RemotePort: 443, Pid: 21, Cmd: "wget", Inode: 200},
+			},
+		},
+	})
+
+	processLookupLock.Lock()
+	globalProcessLookup = make(map[packetMetaDataKey]packetMetaData)
+	journalNextLookup = nil
+	processLookupLock.Unlock()
+	j, err := openJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		globalProcessLookup = make(map[packetMetaDataKey]packetMetaData)
+		journalNextLookup = nil
+	})
+
+	first := map[packetMetaDataKey]uint32{{40000, 80}: 10, {40001, 443}: 20}
+	second := map[packetMetaDataKey]uint32{{40001, 443}: 21, {40002, 53}: 30}
+	tests := []struct {
+		name   string
+		ts     time.Time
+		global map[packetMetaDataKey]uint32
+		next   map[packetMetaDataKey]uint32
+	}{
+		{"before the first record", start.Add(-time.Second), map[packetMetaDataKey]uint32{}, first},
+		{"at the first record", start, first, second},
+		{"between the records", start.Add(500 * time.Millisecond), first, second},
+		{"after the last record", start.Add(2 * time.Second), second, nil},
+	}
+	for _, tt := range tests {
+		j.advance(tt.ts)
+		if got := pids(globalProcessLookup); !reflect.DeepEqual(got, tt.global) {
+			t.Errorf("%s: table is %v, want %v", tt.name, got, tt.global)
+		}
+		if got := pids(journalNextLookup); !reflect.DeepEqual(got, tt.next) {
+			t.Errorf("%s: next table is %v, want %v", tt.name, got, tt.next)
+		}
+	}
+
+	m := globalProcessLookup[packetMetaDataKey{40002, 53}]
+	want := packetMetaData{Magic: tcpSharkMagic, Pid: 30, Cmd: "dig", Inode: 300}
+	if !reflect.DeepEqual(m, want) {
+		t.Errorf("replayed socket is %+v, want %+v", m, want)
+	}
+}
+
+func TestJournalReplayArgs(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	path := writeJournal(t, []journalRecord{{
+		Timestamp: start.UnixNano(),
+		Entries:   []journalEntry{{LocalPort: 40000, RemotePort: 80, Pid: 10, Cmd: "curl", Args: "curl example.com"}},
+	}})
+	j, err := openJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replay = j
+	t.Cleanup(func() {
+		replay = nil
+		globalProcessLookup = make(map[packetMetaDataKey]packetMetaData)
+		journalNextLookup = nil
+	})
+	j.advance(start)
+
+	// the recorded arguments are used instead of the ones of the live pid
+	m := lookupProcess(2, 6, 40000, 80)
+	if m.Pid != 10 || m.Args != "curl example.com" || m.Source != sourceJournal {
+		t.Errorf("looked up %+v", m)
+	}
+}
+
+func TestJournalReplayLongArgs(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	// a command line longer than the uint16 length of the arguments, such as
+	// a long Java classpath
+	args := "java -cp " + strings.Repeat("/opt/lib/a.jar:", 5000)
+	path := writeJournal(t, []journalRecord{
+		{
+			Timestamp: start.UnixNano(),
+			Entries: []journalEntry{
+				newJournalEntry(packetMetaDataKey{40000, 80}, packetMetaData{Pid: 10, Cmd: strings.Repeat("j", 300)}, args),
+				newJournalEntry(packetMetaDataKey{40001, 443}, packetMetaData{Pid: 20, Cmd: "wget"}, "wget example.com"),
+			},
+		},
+		{
+			Timestamp: start.Add(time.Second).UnixNano(),
+			Entries:   []journalEntry{newJournalEntry(packetMetaDataKey{40002, 53}, packetMetaData{Pid: 30, Cmd: "dig"}, "dig example.com")},
+		},
+	})
+	j, err := openJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replay = j
+	t.Cleanup(func() {
+		replay = nil
+		globalProcessLookup = make(map[packetMetaDataKey]packetMetaData)
+		journalNextLookup = nil
+	})
+
+	j.advance(start)
+	if m := lookupProcess(2, 6, 40000, 80); m.Pid != 10 || len(m.Cmd) != 0xFF || m.Args != args[:0xFFFF] {
+		t.Errorf("looked up pid %d, a %d bytes command and %d bytes of arguments", m.Pid, len(m.Cmd), len(m.Args))
+	}
+	if m := lookupProcess(2, 6, 40001, 443); m.Pid != 20 || m.Args != "wget example.com" {
+		t.Errorf("looked up %+v after the long arguments", m)
+	}
+	j.advance(start.Add(time.Second))
+	if m := lookupProcess(2, 17, 40002, 53); m.Pid != 30 || m.Args != "dig example.com" {
+		t.Errorf("looked up %+v in the record after the long arguments", m)
+	}
+}
@@ -5,14 +5,18 @@ import (
 	_ "embed"
 	"encoding/json"
 	"fmt"
+	"net"
+	"net/netip"
 	"os"
 	"os/signal"
 	"runtime"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/rs/zerolog/log"
 
+	"github.com/gopacket/gopacket/layers"
 	"github.com/gopacket/gopacket/pcap"
 	flags "github.com/jessevdk/go-flags"
 	"github.com/mosajjal/tcpshark/netstat"
@@ -24,6 +28,46 @@ const tcpSharkMagic = 0xA1BFF3D4
 // globalProcessLookup  maps source port and dest port to a pid
 var globalProcessLookup = make(map[packetMetaDataKey]packetMetaData)
 
+// bpfSocketKey identifies a socket reported by the eBPF programs. TCP and UDP
+// sockets may share ports
+type bpfSocketKey struct {
+	Protocol layers.IPProtocol
+	packetMetaDataKey
+}
+
+// bpfSocket is a socket reported by the eBPF programs, dropped once it expires
+type bpfSocket struct {
+	metadata packetMetaData
+	tid      uint32
+	cookie   uint64
+	expires  time.Time
+}
+
+// bpfProcessLookup holds the sockets streamed in real time by the eBPF
+// programs. It takes precedence over globalProcessLookup, which only sees the
+// sockets alive when the tables are polled
+var bpfProcessLookup = make(map[bpfSocketKey]bpfSocket)
+
+// bpfCookies maps the cookies of the eBPF sockets to their key in
+// bpfProcessLookup, to attribute the packets of --cgroup without their ports
+var bpfCookies = make(map[uint64]bpfSocketKey)
+
+// namespaceSocketKey identifies a socket of another network namespace, such as
+// the one of a container. Ports collide across namespaces, so the local
+// address tells them apart
+type namespaceSocketKey struct {
+	LocalAddr             netip.Addr
+	LocalPort, RemotePort uint16
+}
+
+// namespaceProcessLookup holds the sockets of the other network namespaces,
+// only looked up for the inner flow of tunnels with --tunnel-inner
+var namespaceProcessLookup = make(map[namespaceSocketKey]packetMetaData)
+
+// processLookupLock guards globalProcessLookup, bpfProcessLookup, bpfCookies
+// and namespaceProcessLookup
+var processLookupLock sync.RWMutex
+
 func handleInterrupt() {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
@@ -40,43 +84,284 @@ func handleInterrupt() {
 	}()
 }
 
-func lookupProcess(verbosity uint8, srcPort uint16, dstPort uint16) packetMetaData {
-	localProcess := globalProcessLookup[packetMetaDataKey{srcPort, dstPort}]
+func lookupProcess(verbosity uint8, protocol layers.IPProtocol, srcPort uint16, dstPort uint16) packetMetaData {
+	processLookupLock.RLock()
+	localProcess, found := lookupSocket(protocol, packetMetaDataKey{srcPort, dstPort})
+	localProcess.Direction = directionOutgoing
+	if !found {
+		// incoming packets have the local port as destination
+		localProcess, found = lookupSocket(protocol, packetMetaDataKey{dstPort, srcPort})
+		localProcess.Direction = directionIncoming
+	}
+	processLookupLock.RUnlock()
+	if !found {
+		localProcess.Direction = directionUnknown
+	}
+	return withVerbosity(verbosity, localProcess)
+}
+
+// lookupInnerProcess looks up the inner flow of a tunnel, which may belong to
+// a socket of another network namespace. Sockets of the current namespace are
+// looked up by port otherwise
+func lookupInnerProcess(verbosity uint8, protocol layers.IPProtocol, srcAddr, dstAddr netip.Addr, srcPort, dstPort uint16) packetMetaData {
+	processLookupLock.RLock()
+	m, found := namespaceProcessLookup[namespaceSocketKey{srcAddr, srcPort, dstPort}]
+	m.Direction = directionOutgoing
+	if !found {
+		m, found = namespaceProcessLookup[namespaceSocketKey{dstAddr, dstPort, srcPort}]
+		m.Direction = directionIncoming
+	}
+	processLookupLock.RUnlock()
+	if !found {
+		return lookupProcess(verbosity, protocol, srcPort, dstPort)
+	}
+	m.Source = sourceSocketTable
+	return withVerbosity(verbosity, m)
+}
+
+// lookupCookie returns the metadata of the socket with a cookie, as reported
+// by the eBPF programs
+func lookupCookie(verbosity uint8, cookie uint64) (packetMetaData, bool) {
+	if cookie == 0 {
+		return packetMetaData{}, false
+	}
+	processLookupLock.RLock()
+	s, found := bpfProcessLookup[bpfCookies[cookie]]
+	processLookupLock.RUnlock()
+	if !found || s.cookie != cookie {
+		return packetMetaData{}, false
+	}
+	m := s.metadata
+	m.Source = sourceCookie
+	return withVerbosity(verbosity, m), true
+}
+
+// withVerbosity keeps the fields of the metadata of a socket that --verbosity
+// asks for
+func withVerbosity(verbosity uint8, localProcess packetMetaData) packetMetaData {
 	localProcess.Magic = tcpSharkMagic
 	switch verbosity {
 	case 0:
-		localProcess.CmdLen = 0
 		localProcess.Cmd = ""
+		localProcess.Args = ""
 	case 2:
-		// read cmdline from /proc/pid/cmdline
-		p, _ := process.NewProcess(int32(localProcess.Pid))
-		cmdlineWithArgs, _ := p.Cmdline()
-		localProcess.ArgsLen = uint16(len(cmdlineWithArgs))
-		localProcess.Args = cmdlineWithArgs
+		// read cmdline from /proc/pid/cmdline, unless it was recorded in a
+		// journal
+		if localProcess.Args == "" {
+			p, _ := process.NewProcess(int32(localProcess.Pid))
+			cmdlineWithArgs, _ := p.Cmdline()
+			localProcess.Args = cmdlineWithArgs
+		}
+	default:
+		localProcess.Args = ""
 	}
 
 	return localProcess
 }
 
+// lookupSocket returns the metadata of the socket with a local and a remote
+// port. processLookupLock must be held
+func lookupSocket(protocol layers.IPProtocol, key packetMetaDataKey) (packetMetaData, bool) {
+	if s, ok := bpfProcessLookup[bpfSocketKey{protocol, key}]; ok {
+		m := s.metadata
+		m.Source = sourceEBPF
+		return m, true
+	}
+	source := uint8(sourceSocketTable)
+	if replay != nil {
+		source = sourceJournal
+	}
+	m, found := globalProcessLookup[key]
+	if !found && journalNextLookup != nil {
+		m, found = journalNextLookup[key]
+	}
+	m.Source = source
+	if !found {
+		m.Source = sourceNone
+	}
+	return m, found
+}
+
+// sockTables are the socket tables polled to build the process lookup table
+var sockTables = []func(netstat.AcceptFn) ([]netstat.SockTabEntry, error){
+	netstat.TCPSocks,
+	netstat.UDPSocks,
+}
+
+// optionalSockTables are the socket tables of the protocols the kernel may not
+// have, or whose inet_diag may be blocked by a sandbox. A table that fails is
+// skipped from then on
+var optionalSockTables = []struct {
+	name   string
+	socks  func(netstat.AcceptFn) ([]netstat.SockTabEntry, error)
+	failed bool
+}{
+	{name: "UDP-Lite", socks: netstat.UDPLiteSocks},
+	{name: "DCCP", socks: netstat.DCCPSocks},
+	{name: "SCTP", socks: netstat.SCTPSocks},
+}
+
+func reloadProcessLookup() {
+	plookup := make(map[packetMetaDataKey]packetMetaData)
+	var connData []netstat.SockTabEntry
+	for _, socks := range sockTables {
+		c, err := socks(netstat.NoopFilter)
+		if err != nil {
+			log.Fatal().Msg(err.Error())
+		}
+		connData = append(connData, c...)
+	}
+	for i := range optionalSockTables {
+		t := &optionalSockTables[i]
+		if t.failed {
+			continue
+		}
+		c, err := t.socks(netstat.NoopFilter)
+		if err != nil {
+			log.Warn().Msgf("%s sockets can't be listed, their packets won't be attributed: %s", t.name, err)
+			t.failed = true
+			continue
+		}
+		connData = append(connData, c...)
+	}
+	for _, c := range connData {
+		if c.Process != nil {
+			// the lookup is performed by source port and dest port
+			plookup[packetMetaDataKey{uint16(c.LocalAddr.Port), uint16(c.RemoteAddr.Port)}] = socketMetaData(c)
+		}
+	}
+	log.Info().Msgf("Reloaded process lookup table with %d connections", len(connData))
+	var nlookup map[namespaceSocketKey]packetMetaData
+	if generalOptions.TunnelInner {
+		nlookup = namespaceLookup()
+	}
+
+	now := time.Now()
+	processLookupLock.Lock()
+	globalProcessLookup = plookup
+	if nlookup != nil {
+		namespaceProcessLookup = nlookup
+	}
+	live := make(map[uint32]bool)
+	for _, m := range globalProcessLookup {
+		live[m.Pid] = true
+	}
+	for _, m := range namespaceProcessLookup {
+		live[m.Pid] = true
+	}
+	for k, s := range bpfProcessLookup {
+		if now.After(s.expires) {
+			delete(bpfProcessLookup, k)
+			if bpfCookies[s.cookie] == k {
+				delete(bpfCookies, s.cookie)
+			}
+			continue
+		}
+		live[s.metadata.Pid] = true
+	}
+	processLookupLock.Unlock()
+	pruneProcessCgroups(live)
+}
+
+// socketMetaData returns the metadata of the process owning a socket
+func socketMetaData(c netstat.SockTabEntry) packetMetaData {
+	return packetMetaData{
+		Magic: tcpSharkMagic,
+		Pid:   uint32(c.Process.Pid),
+		Cmd:   c.Process.Name,
+		Args:  "",
+		Inode: c.Inode,
+		UID:   c.UID,
+	}
+}
+
+// namespaceLookup returns the lookup table of the sockets of the other network
+// namespaces, by local address and ports. The sockets bound to any address
+// are looked up by every address of their namespace
+func namespaceLookup() map[namespaceSocketKey]packetMetaData {
+	lookup := make(map[namespaceSocketKey]packetMetaData)
+	socks, err := netstat.NamespaceSocks(netstat.NoopFilter)
+	if err != nil {
+		log.Warn().Msg(err.Error())
+		return lookup
+	}
+	addrs, err := netstat.NamespaceAddrs()
+	if err != nil {
+		log.Warn().Msg(err.Error())
+	}
+	for _, c := range socks {
+		if c.Process == nil {
+			continue
+		}
+		local := []net.IP{c.LocalAddr.IP}
+		if c.LocalAddr.IP.IsUnspecified() {
+			local = addrs[c.Netns]
+		}
+		for _, ip := range local {
+			if addr, ok := netip.AddrFromSlice(ip); ok {
+				lookup[namespaceSocketKey{addr.Unmap(), c.LocalAddr.Port, c.RemoteAddr.Port}] = socketMetaData(c)
+			}
+		}
+	}
+	log.Info().Msgf("Reloaded namespace lookup table with %d connections", len(socks))
+	return lookup
+}
+
 //go:embed tcpshark.lua
 var tcpsharkLua string
 
 var generalOptions struct {
-	OutFile        flags.Filename `long:"outfile"         short:"o"                 required:"true"  description:"Output pcap file path. Use '-' for stdout" `
-	Interface      string         `long:"interface"       short:"i"    default:"lo" required:"true"  description:"Interface to use. Only supports Ethernet type packets interfaces. Do not use it on SPANs"`
-	Bpf            string         `long:"bpf"             short:"f"    default:""   required:"false" description:"tcpdump-style BPF filter"`
-	Verbosity      uint8          `long:"verbosity"       short:"v"    default:"1"  required:"false" description:"Verbosity of the metadata: 0 - only pid, 1 - pid and cmd, 2 - pid, cmd and args"`
-	ListInterfaces bool           `long:"list-interfaces" short:"l"                 required:"false" description:"List available interfaces and exit"`
-	LuaDissector   bool           `long:"lua-dissector"   short:"d"                 required:"false" description:"Print the Lua dissector used in Wireshark"`
+	OutFile           flags.Filename `long:"outfile"             short:"o"                   required:"false" description:"Output pcap file path. Use '-' for stdout"`
+	ReadFile          flags.Filename `long:"read"                short:"r"                   required:"false" description:"Annotate a pcap or pcapng file instead of capturing an interface. Use '-' for stdin"`
+	JournalWrite      flags.Filename `long:"journal-write"                                   required:"false" description:"Only record the process lookup table to a journal file, to annotate a capture taken by another tool later on"`
+	Journal           flags.Filename `long:"journal"                                         required:"false" description:"Attribute the packets of --read with a journal recorded by --journal-write instead of the current sockets"`
+	Interface         []string       `long:"interface"           short:"i" default:"lo"      required:"true"  description:"Interfaces to use, repeat it to capture several interfaces at once. Globs such as 'veth*' also capture the matching interfaces created later on. Supports Ethernet, Linux cooked (any), loopback and raw IP interfaces. Do not use it on SPANs"`
+	Cgroup            string         `long:"cgroup"                                          required:"false" description:"Capture the packets of a cgroup v2 path, such as /sys/fs/cgroup/system.slice/nginx.service, with eBPF instead of an interface"`
+	Metadata          string         `long:"metadata"                      default:"trailer" required:"false" choice:"trailer" choice:"options" choice:"darwin" choice:"inventory" description:"Where the process metadata is written: trailer appends it to each frame, inventory only appends a reference to the process, written once to a process inventory, options writes it as pcapng packet options, darwin as the Process Information Blocks of macOS, read by Wireshark without tcpshark.lua. Frames are untouched with options and darwin"`
+	InventoryInterval time.Duration  `long:"inventory-interval"            default:"1m"      required:"false" description:"How often the whole process inventory is written with --metadata inventory, new processes are written right away"`
+	Passthrough       bool           `long:"passthrough"                                     required:"false" description:"Keep the original bytes of each frame, including VLAN tags, padding, FCS and trailers of other tools, and only append the tcpshark trailer"`
+	FCS               string         `long:"fcs"                           default:"crc"     required:"false" choice:"crc" choice:"zero" choice:"none" description:"FCS of the Ethernet frames carrying a trailer: crc computes their CRC32, zero writes 4 zero bytes as older versions did, none leaves it out. crc and none tell readers with the if_fcslen option of the interfaces"`
+	SnapLen           int            `long:"snaplen"             short:"s" default:"65536"   required:"false" description:"Bytes of each packet to capture. Truncated packets keep their original length"`
+	NoPromisc         bool           `long:"no-promisc"          short:"p"                   required:"false" description:"Don't put the interfaces in promiscuous mode"`
+	BufferSize        int            `long:"buffer-size"         short:"B" default:"0"       required:"false" description:"Kernel capture buffer size in KiB, 0 for the libpcap default"`
+	Immediate         bool           `long:"immediate"                                       required:"false" description:"Deliver packets as soon as they arrive instead of buffering them in the kernel"`
+	ReadTimeout       time.Duration  `long:"read-timeout"                  default:"0s"      required:"false" description:"How long the kernel buffers packets before delivering them, 0 to wait until the buffer is full"`
+	TimeStampType     string         `long:"time-stamp-type"     short:"j"                   required:"false" description:"Time stamp source of the interfaces, such as host, host_hiprec or adapter. Supported sources are listed on error"`
+	AFPacket          bool           `long:"afpacket"                                        required:"false" description:"Capture interfaces with AF_PACKET TPACKET_V3 rings instead of libpcap (Linux only)"`
+	AFPacketBlockSize int            `long:"afpacket-block-size"           default:"1048576" required:"false" description:"Size in bytes of each block of the AF_PACKET rings, a multiple of the page size"`
+	AFPacketBlocks    int            `long:"afpacket-blocks"               default:"64"      required:"false" description:"Number of blocks of each AF_PACKET ring"`
+	AFPacketFanout    int            `long:"afpacket-fanout"               default:"1"       required:"false" description:"Number of AF_PACKET sockets and goroutines sharing the packets of each interface with PACKET_FANOUT"`
+	Process           []string       `long:"process"                                         required:"false" description:"Only capture the packets of these processes, given by pid or command. Repeat it or separate them with commas"`
+	Remote            string         `long:"remote"                                          required:"false" description:"Capture on a host over SSH, such as user@host, with the flags given after --. tcpshark is copied to --remote-binary, run with sudo unless logging in as root, and its own SSH session is excluded. The capture is written to --outfile"`
+	RemoteBinary      string         `long:"remote-binary"                 default:".local/bin/tcpshark" required:"false" description:"Path of tcpshark on the --remote host, relative to the home directory of the login user unless it's absolute. This binary is copied there if the host has the same OS and architecture and the binary there differs. It's only run if it and its directory are owned by root or the login user and not writable by other users"`
+	ExcludeConnection string         `long:"exclude-connection"                              required:"false" description:"Exclude a TCP connection given as 'client_ip client_port server_ip server_port', the format of $SSH_CONNECTION, from the capture"`
+	KeepOwnTraffic    bool           `long:"keep-own-traffic"                                required:"false" description:"Also capture the packets of tcpshark, its parent processes in its session, the SSH session it runs in, and the processes reading its output, which are left out when -o - writes to a pipe or a socket to avoid capturing the output"`
+	Bpf               string         `long:"bpf"                 short:"f" default:""        required:"false" description:"tcpdump-style BPF filter"`
+	Fields            string         `long:"fields"                                          required:"false" description:"Comma separated fields of the trailer, out of pid, cmd, args, inode, cookie, uid, cgroup, direction and source. Overrides --verbosity"`
+	Verbosity         uint8          `long:"verbosity"           short:"v" default:"1"       required:"false" description:"Verbosity of the metadata: 0 - only pid, 1 - pid and cmd, 2 - pid, cmd and args"`
+	FragmentTimeout   time.Duration  `long:"fragment-timeout"              default:"30s"     required:"false" description:"How long the attribution of the first IP fragment is kept for the rest of its datagram"`
+	TunnelInner       bool           `long:"tunnel-inner"                                    required:"false" description:"Also attribute the inner flow of VXLAN, Geneve, GRE and IP-in-IP packets, looking up sockets in all network namespaces"`
+	EBPF              bool           `long:"ebpf"                                            required:"false" description:"Stream socket events from eBPF programs to attribute short lived connections. Only the socket tables are polled if eBPF is not available"`
+	ProcEvents        bool           `long:"proc-events"                                     required:"false" description:"Write process exec and exit events to the capture as pcapng custom blocks (Linux only). Needs --experimental-blocks"`
+	CustomBlocks      bool           `long:"experimental-blocks"                             required:"false" description:"Write pcapng custom blocks and options, with the documentation PEN 32473 until tcpshark has a registered one. Other tools may use the same PEN, so readers can't be sure the data is tcpshark's"`
+	ListInterfaces    bool           `long:"list-interfaces"     short:"l"                   required:"false" description:"List available interfaces and exit"`
+	LuaDissector      bool           `long:"lua-dissector"       short:"d"                   required:"false" description:"Print the Lua dissector used in Wireshark"`
 }
 
 func main() {
 	parser := flags.NewNamedParser("tcpshark", flags.PassDoubleDash|flags.PrintErrors|flags.HelpFlag)
 	_, _ = parser.AddGroup("tcpshark", "tcpshark Options", &generalOptions)
-	if _, err := parser.Parse(); err != nil {
+	_, _ = parser.AddGroup("Wireshark extcap", "Flags passed by Wireshark when tcpshark is installed as an extcap binary", &extcapOptions)
+	args, err := parser.Parse()
+	if err != nil {
 		os.Exit(-1)
 	}
 
+	if extcapQuery() {
+		os.Exit(0)
+	}
+	setupExtcapCapture()
+
 	if generalOptions.ListInterfaces {
 		ifaces, err := pcap.FindAllDevs()
 		if err != nil {
@@ -96,37 +381,84 @@ func main() {
 		os.Exit(0)
 	}
 
+	if generalOptions.OutFile == "" && generalOptions.JournalWrite == "" {
+		log.Fatal().Msg("the required flag `-o, --outfile' was not specified")
+	}
+	if generalOptions.Journal != "" && generalOptions.ReadFile == "" {
+		log.Fatal().Msg("--journal can only be used with --read")
+	}
+
+	if generalOptions.Remote != "" {
+		captureRemote(args)
+		return
+	}
+	if generalOptions.ExcludeConnection != "" {
+		exclusion, err := connectionFilter(generalOptions.ExcludeConnection)
+		if err != nil {
+			log.Fatal().Msg(err.Error())
+		}
+		generalOptions.Bpf = andFilters(generalOptions.Bpf, exclusion)
+	}
+
+	fields, verbosity, err := parseTrailerFields(generalOptions.Fields, generalOptions.Verbosity)
+	if err != nil {
+		log.Fatal().Msg(err.Error())
+	}
+	trailerFields, generalOptions.Verbosity = fields, verbosity
+	selectedPids, selectedCommands = parseProcesses(generalOptions.Process)
+	// commands of --process are matched against the command of the packets
+	if len(selectedCommands) > 0 {
+		generalOptions.Verbosity = max(generalOptions.Verbosity, 1)
+	}
+
+	// the packets of --cgroup are attributed by the cookie of their socket
+	if generalOptions.EBPF || generalOptions.Cgroup != "" {
+		if err := startBPFAttribution(); err != nil {
+			log.Warn().Msgf("eBPF attribution is not available, polling the socket tables only: %s", err)
+		}
+	}
+
+	if generalOptions.ProcEvents && !generalOptions.CustomBlocks {
+		log.Fatal().Msg("--proc-events writes pcapng custom blocks, which are experimental: add --experimental-blocks")
+	}
+	// process events keep the process cache accurate between reloads
+	if generalOptions.ProcEvents {
+		procEvents = make(chan netstat.ProcEvent, 1024)
+	}
+	if err := netstat.WatchProcesses(procEvents); err != nil {
+		log.Debug().Msgf("process events are not available: %s", err)
+		if generalOptions.ProcEvents {
+			log.Warn().Msgf("process events won't be written: %s", err)
+		}
+	}
+
 	handleInterrupt()
 
-	// reload the process lookup table every second
+	if generalOptions.JournalWrite != "" {
+		recordJournal(string(generalOptions.JournalWrite))
+	}
+
+	// a journal replaces the socket tables, it's advanced by the packet
+	// timestamps in capture
+	if generalOptions.Journal != "" {
+		var err error
+		replay, err = openJournal(string(generalOptions.Journal))
+		if err != nil {
+			log.Fatal().Msg(err.Error())
+		}
+		capture()
+		return
+	}
+
+	// reload the process lookup table every second. The first load is done
+	// right away, so the first packets, or a whole file read with --read,
+	// are attributed
+	reloadProcessLookup()
+	updateOwnProcesses()
 	go func() {
 		for range time.Tick(time.Second) {
-			plookup := make(map[packetMetaDataKey]packetMetaData)
-			connData, err := netstat.TCPSocks(netstat.NoopFilter)
-			if err != nil {
-				log.Fatal().Msg(err.Error())
-			}
-			u, err := netstat.UDPSocks(netstat.NoopFilter)
-			if err != nil {
-				log.Fatal().Msg(err.Error())
-			}
-			connData = append(connData, u...)
-			for _, c := range connData {
-				if c.Process != nil {
-					// the lookup is performed by source port and dest port
-					plookup[packetMetaDataKey{uint16(c.LocalAddr.Port), uint16(c.RemoteAddr.Port)}] = packetMetaData{
-						Magic:   tcpSharkMagic,
-						Pid:     uint32(c.Process.Pid),
-						CmdLen:  uint8(len(c.Process.Name)),
-						Cmd:     c.Process.Name,
-						ArgsLen: 0,
-						Args:    "",
-					}
-				}
-			}
-			log.Info().Msgf("Reloaded process lookup table with %d connections", len(connData))
-
-			globalProcessLookup = plookup
+			reloadProcessLookup()
+			updateOwnProcesses()
 		}
 	}()
 
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"container/heap"
+	"errors"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/gopacket/gopacket/pcap"
+	"github.com/rs/zerolog/log"
+)
+
+// mergeWindow is how long packets are held after they're read before being
+// written, so the packets of an interface read a bit late are still written in
+// order
+const mergeWindow = 100 * time.Millisecond
+
+// sourcePacket is a packet, or the error, read from one of the interfaces of
+// a mergedSource
+type sourcePacket struct {
+	name string
+	data []byte
+	ci   gopacket.CaptureInfo
+	err  error
+	// received is when the packet was read. The timestamp orders the packets,
+	// but it may come from the clock of the NIC, ahead of the one of the host
+	received time.Time
+}
+
+// packetHeap orders packets by timestamp. It implements heap.Interface
+type packetHeap []sourcePacket
+
+func (h packetHeap) Len() int           { return len(h) }
+func (h packetHeap) Less(i, j int) bool { return h[i].ci.Timestamp.Before(h[j].ci.Timestamp) }
+func (h packetHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *packetHeap) Push(x any)        { *h = append(*h, x.(sourcePacket)) }
+func (h *packetHeap) Pop() any {
+	old := *h
+	p := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return p
+}
+
+// isInterfacePattern reports whether an --interface value is a glob such as
+// 'veth*' rather than an interface name
+func isInterfacePattern(name string) bool {
+	return strings.ContainsAny(name, "*?[")
+}
+
+// matchInterface reports whether an interface is selected by the names and
+// patterns of --interface
+func matchInterface(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// mergedSource captures the interfaces selected by --interface and returns
+// their annotated packets in timestamp order, with the interface index of the
+// output as InterfaceIndex. Packets are annotated by the goroutine reading
+// them. Interfaces matching a pattern are added to the output as they appear,
+// and interfaces that go away are dropped. It implements
+// gopacket.PacketDataSource
+type mergedSource struct {
+	patterns  []string
+	filter    string
+	out       *captureOutput
+	fragments *fragmentTable
+	packets   chan sourcePacket
+	pending   packetHeap
+	// active are the interfaces being captured, with their number of
+	// readers. AF_PACKET fanout has several readers per interface
+	active  map[string]int
+	readers int
+	// added are the interfaces created while capturing, nil if they can't be
+	// watched
+	added chan string
+}
+
+func newMergedSource(patterns []string, filter string, out *captureOutput, fragments *fragmentTable) *mergedSource {
+	m := &mergedSource{
+		patterns:  patterns,
+		filter:    filter,
+		out:       out,
+		fragments: fragments,
+		packets:   make(chan sourcePacket, 1024),
+		active:    make(map[string]int),
+		added:     make(chan string, 64),
+	}
+	if err := watchInterfaces(m.added); err != nil {
+		log.Debug().Msgf("new interfaces won't be captured: %s", err)
+		m.added = nil
+	}
+	for _, name := range patterns {
+		if isInterfacePattern(name) {
+			continue
+		}
+		// interfaces given by name must exist at start
+		if err := m.open(name); err != nil {
+			log.Fatal().Msg(err.Error())
+		}
+	}
+	devs, err := pcap.FindAllDevs()
+	if err != nil {
+		log.Warn().Msg(err.Error())
+	}
+	for _, dev := range devs {
+		if err := m.open(dev.Name); err != nil {
+			log.Warn().Msg(err.Error())
+		}
+	}
+	if len(m.active) == 0 && m.added == nil {
+		log.Fatal().Msgf("no interface matches %s", strings.Join(patterns, ", "))
+	}
+	return m
+}
+
+// open starts capturing an interface if it's selected and not captured yet
+func (m *mergedSource) open(name string) error {
+	if m.active[name] > 0 || !matchInterface(m.patterns, name) {
+		return nil
+	}
+	var sources []packetSource
+	if generalOptions.AFPacket {
+		var err error
+		sources, err = openAFPacket(name, m.filter)
+		if err != nil {
+			return err
+		}
+	} else {
+		handle, err := openLivePcap(name, m.filter)
+		if err != nil {
+			return err
+		}
+		sources = append(sources, handle)
+	}
+	comment := ""
+	if generalOptions.TimeStampType != "" {
+		comment = "time stamp type: " + generalOptions.TimeStampType
+	}
+	index, err := m.out.addInterface(name, sources[0], comment)
+	if err != nil {
+		for _, source := range sources {
+			closeSource(source)
+		}
+		return err
+	}
+	linkType, _ := supportedLinkType(sources[0].LinkType())
+	m.active[name] = len(sources)
+	m.readers += len(sources)
+	for _, source := range sources {
+		go m.read(name, index, linkType, source)
+	}
+	return nil
+}
+
+// closeSource closes a source, if it can be closed
+func closeSource(source packetSource) {
+	if c, ok := source.(interface{ Close() }); ok {
+		c.Close()
+	}
+}
+
+// read annotates the packets of an interface and sends them to m.packets
+// until it fails, which happens when the interface goes away
+func (m *mergedSource) read(name string, index int, linkType layers.LinkType, source packetSource) {
+	defer closeSource(source)
+	for {
+		data, ci, err := source.ReadPacketData()
+		if err == pcap.NextErrorTimeoutExpired {
+			// --read-timeout passed without packets
+			continue
+		}
+		received := time.Now()
+		if err != nil {
+			m.packets <- sourcePacket{name: name, ci: gopacket.CaptureInfo{Timestamp: received}, err: err, received: received}
+			return
+		}
+		ci.InterfaceIndex = index
+		frame, options := annotate(m.fragments, linkType, data, ci)
+		if frame == nil {
+			continue
+		}
+		if options != nil {
+			ci.AncillaryData = append(ci.AncillaryData, options)
+		}
+		m.packets <- sourcePacket{name: name, data: frame, ci: ci, received: received}
+	}
+}
+
+// ReadPacketData returns the oldest packet once it's been read mergeWindow ago.
+// Packets are returned right away when there's a single reader
+func (m *mergedSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	for {
+		var wait <-chan time.Time
+		if len(m.pending) > 0 {
+			window := mergeWindow
+			if m.readers <= 1 {
+				window = 0
+			}
+			d := time.Until(m.pending[0].received.Add(window))
+			if d <= 0 {
+				p := heap.Pop(&m.pending).(sourcePacket)
+				if p.err != nil {
+					m.readers--
+					m.active[p.name]--
+					if m.active[p.name] <= 0 {
+						log.Warn().Msgf("stopped capturing %s: %s", p.name, p.err)
+						delete(m.active, p.name)
+					}
+					continue
+				}
+				return p.data, p.ci, nil
+			}
+			wait = time.After(d)
+		} else if len(m.active) == 0 && m.added == nil {
+			return nil, gopacket.CaptureInfo{}, errors.New("no interface left to capture")
+		}
+		select {
+		case p := <-m.packets:
+			heap.Push(&m.pending, p)
+		case name := <-m.added:
+			if err := m.open(name); err != nil {
+				log.Warn().Msg(err.Error())
+			}
+		case <-wait:
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package netstat
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// DCCP has no table in /proc/net, its sockets are only listed by inet_diag,
+// the netlink interface of ss. The kernel loads dccp_diag on demand, and
+// kernels since 6.16 have no DCCP at all
+const (
+	ipprotoDCCP = 33
+
+	inetDiagReqV2Len = 56
+	inetDiagMsgLen   = 72
+)
+
+// parseInetDiagMsg parses a struct inet_diag_msg
+func parseInetDiagMsg(b []byte) (SockTabEntry, bool) {
+	var e SockTabEntry
+	if len(b) < inetDiagMsgLen {
+		return e, false
+	}
+	ipLen := net.IPv4len
+	if b[0] == unix.AF_INET6 {
+		ipLen = net.IPv6len
+	}
+	e.LocalAddr = &SockAddr{
+		IP:   net.IP(append([]byte(nil), b[8:8+ipLen]...)),
+		Port: binary.BigEndian.Uint16(b[4:6]),
+	}
+	e.RemoteAddr = &SockAddr{
+		IP:   net.IP(append([]byte(nil), b[24:24+ipLen]...)),
+		Port: binary.BigEndian.Uint16(b[6:8]),
+	}
+	e.State = SkState(b[1])
+	e.UID = binary.NativeEndian.Uint32(b[64:68])
+	e.Inode = uint64(binary.NativeEndian.Uint32(b[68:72]))
+	return e, true
+}
+
+// inetDiagSocks dumps the sockets of an address family and a protocol with
+// SOCK_DIAG_BY_FAMILY. A protocol the kernel doesn't have yields no sockets
+func inetDiagSocks(family, protocol uint8, accept AcceptFn) ([]SockTabEntry, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, unix.NETLINK_SOCK_DIAG)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(fd)
+
+	// nlmsghdr and inet_diag_req_v2, matching the sockets in any state
+	req := make([]byte, unix.NLMSG_HDRLEN+inetDiagReqV2Len)
+	binary.NativeEndian.PutUint32(req[0:4], uint32(len(req)))
+	binary.NativeEndian.PutUint16(req[4:6], unix.SOCK_DIAG_BY_FAMILY)
+	binary.NativeEndian.PutUint16(req[6:8], unix.NLM_F_REQUEST|unix.NLM_F_DUMP)
+	r := req[unix.NLMSG_HDRLEN:]
+	r[0] = family
+	r[1] = protocol
+	binary.NativeEndian.PutUint32(r[4:8], 0xFFFFFFFF)
+	if err := unix.Sendto(fd, req, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return nil, err
+	}
+
+	tab := make([]SockTabEntry, 0, 4)
+	buf := make([]byte, 8*os.Getpagesize())
+	for {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if errors.Is(err, unix.EINTR) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range msgs {
+			switch m.Header.Type {
+			case unix.NLMSG_DONE:
+				extractProcInfo(tab)
+				return tab, nil
+			case unix.NLMSG_ERROR:
+				if len(m.Data) < 4 {
+					return nil, unix.EINVAL
+				}
+				errno := syscall.Errno(-int32(binary.NativeEndian.Uint32(m.Data[0:4])))
+				if errno == unix.ENOENT {
+					return nil, nil
+				}
+				return nil, errno
+			}
+			e, ok := parseInetDiagMsg(m.Data)
+			if ok && accept(&e) {
+				tab = append(tab, e)
+			}
+		}
+	}
+}
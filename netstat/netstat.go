@@ -41,12 +41,17 @@ func (s *SockAddr) String() string {
 
 // SockTabEntry type represents each line of the /proc/net/[tcp|udp]
 type SockTabEntry struct {
-	ino        string
+	// Inode is the inode of the socket, as shown by ss -e and lsof. It's
+	// only known on Linux
+	Inode      uint64
 	LocalAddr  *SockAddr
 	RemoteAddr *SockAddr
 	State      SkState
 	UID        uint32
 	Process    *Process
+	// Netns is the inode of the network namespace of the socket, only set by
+	// NamespaceSocks
+	Netns uint64
 }
 
 // Process holds the PID and process name to which each socket belongs
@@ -96,3 +101,34 @@ func UDPSocks(accept AcceptFn) ([]SockTabEntry, error) {
 func UDP6Socks(accept AcceptFn) ([]SockTabEntry, error) {
 	return osUDP6Socks(accept)
 }
+
+// UDPLiteSocks returns a slice of active UDP-Lite sockets containing only
+// those elements that satisfy the accept function
+func UDPLiteSocks(accept AcceptFn) ([]SockTabEntry, error) {
+	return osUDPLiteSocks(accept)
+}
+
+// DCCPSocks returns a slice of active DCCP sockets containing only those
+// elements that satisfy the accept function
+func DCCPSocks(accept AcceptFn) ([]SockTabEntry, error) {
+	return osDCCPSocks(accept)
+}
+
+// SCTPSocks returns a slice of active SCTP associations and endpoints
+// containing only those elements that satisfy the accept function
+func SCTPSocks(accept AcceptFn) ([]SockTabEntry, error) {
+	return osSCTPSocks(accept)
+}
+
+// NamespaceSocks returns a slice of the active sockets of every protocol in
+// all network namespaces other than the current one, such as the ones of
+// containers, containing only those elements that satisfy the accept function
+func NamespaceSocks(accept AcceptFn) ([]SockTabEntry, error) {
+	return osNamespaceSocks(accept)
+}
+
+// NamespaceAddrs returns the local addresses of all network namespaces other
+// than the current one, by inode of the namespace
+func NamespaceAddrs() (map[uint64][]net.IP, error) {
+	return osNamespaceAddrs()
+}
@@ -124,9 +124,7 @@ func parseDarwinNetstat(out string) []SockTabEntry {
 			continue
 		}
 
-		t := SockTabEntry{
-			ino: "tcp",
-		}
+		t := SockTabEntry{}
 
 		// Format is <ip>.<port>
 		locals := strings.Split(fields[3], ".")
@@ -220,3 +218,25 @@ func osUDPSocks(accept AcceptFn) ([]SockTabEntry, error) {
 func osUDP6Socks(accept AcceptFn) ([]SockTabEntry, error) {
 	return osTCPSocks(accept) // todo :fix
 }
+
+// UDP-Lite, DCCP and SCTP socket tables, as well as the sockets of other
+// network namespaces, are not exposed on this platform
+func osUDPLiteSocks(accept AcceptFn) ([]SockTabEntry, error) {
+	return nil, nil
+}
+
+func osDCCPSocks(accept AcceptFn) ([]SockTabEntry, error) {
+	return nil, nil
+}
+
+func osSCTPSocks(accept AcceptFn) ([]SockTabEntry, error) {
+	return nil, nil
+}
+
+func osNamespaceSocks(accept AcceptFn) ([]SockTabEntry, error) {
+	return nil, nil
+}
+
+func osNamespaceAddrs() (map[uint64][]net.IP, error) {
+	return nil, nil
+}
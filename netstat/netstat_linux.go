@@ -39,6 +39,8 @@ import (
 	"path"
 	"strconv"
 	"strings"
+
+	"golang.org/x/sys/unix"
 )
 
 const (
@@ -47,6 +49,11 @@ const (
 	pathUDPTab  = "/proc/net/udp"
 	pathUDP6Tab = "/proc/net/udp6"
 
+	pathUDPLiteTab  = "/proc/net/udplite"
+	pathUDPLite6Tab = "/proc/net/udplite6"
+	pathSCTPAssocs  = "/proc/net/sctp/assocs"
+	pathSCTPEps     = "/proc/net/sctp/eps"
+
 	ipv4StrLen = 8
 	ipv6StrLen = 32
 )
@@ -176,7 +183,128 @@ func parseSocktab(r io.Reader, accept AcceptFn) ([]SockTabEntry, error) {
 			return nil, err
 		}
 		e.UID = uint32(u)
-		e.ino = fields[9]
+		e.Inode, err = strconv.ParseUint(fields[9], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		if accept(&e) {
+			tab = append(tab, e)
+		}
+	}
+	return tab, br.Err()
+}
+
+// parseSCTPAddr parses the textual address used in /proc/net/sctp. The
+// primary path of an association is prefixed with a '*'
+func parseSCTPAddr(s string, port string) (*SockAddr, error) {
+	ip := net.ParseIP(strings.TrimPrefix(s, "*"))
+	if ip == nil {
+		return nil, fmt.Errorf("netstat: bad sctp address: %v", s)
+	}
+	v, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	return &SockAddr{IP: ip, Port: uint16(v)}, nil
+}
+
+// parseSCTPAssocs parses /proc/net/sctp/assocs. Unlike tcp and udp tables,
+// addresses are printed in text form and each association may have several
+// local and remote addresses. Only the first local and the first remote
+// address are kept.
+//
+//	ASSOC     SOCK   STY SST ST HBKT ASSOC-ID TX_QUEUE RX_QUEUE UID INODE LPORT RPORT LADDRS <-> RADDRS ...
+func parseSCTPAssocs(r io.Reader, accept AcceptFn) ([]SockTabEntry, error) {
+	br := bufio.NewScanner(r)
+	tab := make([]SockTabEntry, 0, 4)
+
+	// Discard title
+	br.Scan()
+
+	for br.Scan() {
+		var e SockTabEntry
+		fields := strings.Fields(br.Text())
+		if len(fields) < 16 {
+			return nil, fmt.Errorf("netstat: not enough fields: %v, %v", len(fields), fields)
+		}
+		sep := -1
+		for i := 13; i < len(fields); i++ {
+			if fields[i] == "<->" {
+				sep = i
+				break
+			}
+		}
+		if sep < 14 || sep+1 >= len(fields) {
+			return nil, fmt.Errorf("netstat: malformed sctp association: %v", fields)
+		}
+		addr, err := parseSCTPAddr(fields[13], fields[11])
+		if err != nil {
+			return nil, err
+		}
+		e.LocalAddr = addr
+		addr, err = parseSCTPAddr(fields[sep+1], fields[12])
+		if err != nil {
+			return nil, err
+		}
+		e.RemoteAddr = addr
+		u, err := strconv.ParseUint(fields[3], 10, 8)
+		if err != nil {
+			return nil, err
+		}
+		e.State = SkState(u)
+		u, err = strconv.ParseUint(fields[9], 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		e.UID = uint32(u)
+		e.Inode, err = strconv.ParseUint(fields[10], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		if accept(&e) {
+			tab = append(tab, e)
+		}
+	}
+	return tab, br.Err()
+}
+
+// parseSCTPEps parses /proc/net/sctp/eps, which lists the listening SCTP
+// endpoints. The remote address of those entries is left unspecified.
+//
+//	ENDPT     SOCK   STY SST HBKT LPORT   UID INODE LADDRS
+func parseSCTPEps(r io.Reader, accept AcceptFn) ([]SockTabEntry, error) {
+	br := bufio.NewScanner(r)
+	tab := make([]SockTabEntry, 0, 4)
+
+	// Discard title
+	br.Scan()
+
+	for br.Scan() {
+		var e SockTabEntry
+		fields := strings.Fields(br.Text())
+		if len(fields) < 9 {
+			return nil, fmt.Errorf("netstat: not enough fields: %v, %v", len(fields), fields)
+		}
+		addr, err := parseSCTPAddr(fields[8], fields[5])
+		if err != nil {
+			return nil, err
+		}
+		e.LocalAddr = addr
+		e.RemoteAddr = &SockAddr{IP: net.IPv4zero, Port: 0}
+		u, err := strconv.ParseUint(fields[3], 10, 8)
+		if err != nil {
+			return nil, err
+		}
+		e.State = SkState(u)
+		u, err = strconv.ParseUint(fields[6], 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		e.UID = uint32(u)
+		e.Inode, err = strconv.ParseUint(fields[7], 10, 64)
+		if err != nil {
+			return nil, err
+		}
 		if accept(&e) {
 			tab = append(tab, e)
 		}
@@ -215,8 +343,6 @@ func (p *procFd) iterFdDir() {
 	if err != nil {
 		return
 	}
-	var buf [128]byte
-
 	for _, file := range fi {
 		fd := path.Join(fddir, file.Name())
 		lname, err := os.Readlink(fd)
@@ -226,23 +352,15 @@ func (p *procFd) iterFdDir() {
 
 		for i := range p.sktab {
 			sk := &p.sktab[i]
-			ss := sockPrefix + sk.ino + "]"
+			ss := sockPrefix + strconv.FormatUint(sk.Inode, 10) + "]"
 			if ss != lname {
 				continue
 			}
 			if p.p == nil {
-				stat, err := os.Open(path.Join(p.base, "stat"))
-				if err != nil {
+				p.p = processOf(p.pid)
+				if p.p == nil {
 					return
 				}
-				n, err := stat.Read(buf[:])
-				stat.Close()
-				if err != nil {
-					return
-				}
-				z := bytes.SplitN(buf[:n], []byte(" "), 3)
-				name := getProcName(z[1])
-				p.p = &Process{p.pid, name}
 			}
 			sk.Process = p.p
 		}
@@ -285,6 +403,25 @@ func doNetstat(path string, fn AcceptFn) ([]SockTabEntry, error) {
 	return tabs, nil
 }
 
+// doOptionalNetstat behaves like doNetstat for the socket tables that only
+// exist when the protocol module is loaded. A missing table yields no sockets.
+func doOptionalNetstat(path string, parse func(io.Reader, AcceptFn) ([]SockTabEntry, error), fn AcceptFn) ([]SockTabEntry, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	tabs, err := parse(f, fn)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	extractProcInfo(tabs)
+	return tabs, nil
+}
+
 // TCPSocks returns a slice of active TCP sockets containing only those
 // elements that satisfy the accept function
 func osTCPSocks(accept AcceptFn) ([]SockTabEntry, error) {
@@ -308,3 +445,208 @@ func osUDPSocks(accept AcceptFn) ([]SockTabEntry, error) {
 func osUDP6Socks(accept AcceptFn) ([]SockTabEntry, error) {
 	return doNetstat(pathUDP6Tab, accept)
 }
+
+// UDPLiteSocks returns a slice of active UDP-Lite IPv4 and IPv6 sockets
+// containing only those elements that satisfy the accept function
+func osUDPLiteSocks(accept AcceptFn) ([]SockTabEntry, error) {
+	tabs, err := doOptionalNetstat(pathUDPLiteTab, parseSocktab, accept)
+	if err != nil {
+		return nil, err
+	}
+	tabs6, err := doOptionalNetstat(pathUDPLite6Tab, parseSocktab, accept)
+	if err != nil {
+		return nil, err
+	}
+	return append(tabs, tabs6...), nil
+}
+
+// DCCPSocks returns a slice of active DCCP IPv4 and IPv6 sockets of the
+// current network namespace, listed by inet_diag, containing only those
+// elements that satisfy the accept function
+func osDCCPSocks(accept AcceptFn) ([]SockTabEntry, error) {
+	tabs, err := inetDiagSocks(unix.AF_INET, ipprotoDCCP, accept)
+	if err != nil {
+		return nil, err
+	}
+	tabs6, err := inetDiagSocks(unix.AF_INET6, ipprotoDCCP, accept)
+	if err != nil {
+		return nil, err
+	}
+	return append(tabs, tabs6...), nil
+}
+
+// SCTPSocks returns a slice of SCTP associations and listening endpoints
+// containing only those elements that satisfy the accept function
+func osSCTPSocks(accept AcceptFn) ([]SockTabEntry, error) {
+	tabs, err := doOptionalNetstat(pathSCTPAssocs, parseSCTPAssocs, accept)
+	if err != nil {
+		return nil, err
+	}
+	eps, err := doOptionalNetstat(pathSCTPEps, parseSCTPEps, accept)
+	if err != nil {
+		return nil, err
+	}
+	return append(tabs, eps...), nil
+}
+
+// namespaceTables are the socket tables read from /proc/<pid>/net for each
+// network namespace, along with their parsers. DCCP sockets, only listed by
+// inet_diag in the namespace of the netlink socket, are left out
+var namespaceTables = []struct {
+	name  string
+	parse func(io.Reader, AcceptFn) ([]SockTabEntry, error)
+}{
+	{"tcp", parseSocktab},
+	{"tcp6", parseSocktab},
+	{"udp", parseSocktab},
+	{"udp6", parseSocktab},
+	{"udplite", parseSocktab},
+	{"udplite6", parseSocktab},
+	{"sctp/assocs", parseSCTPAssocs},
+	{"sctp/eps", parseSCTPEps},
+}
+
+// netNamespace is a network namespace, with one of the pids living in it
+type netNamespace struct {
+	pid   int
+	inode uint64
+}
+
+// otherNamespaces returns the network namespaces other than the namespace of
+// the current process
+func otherNamespaces() ([]netNamespace, error) {
+	self, err := os.Readlink("/proc/self/ns/net")
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{self: true}
+	var namespaces []netNamespace
+	for _, file := range fi {
+		pid, err := strconv.Atoi(file.Name())
+		if err != nil {
+			continue
+		}
+		// the link name is of the form net:[4026531840]
+		ns, err := os.Readlink(path.Join("/proc", file.Name(), "ns/net"))
+		if err != nil || seen[ns] {
+			continue
+		}
+		seen[ns] = true
+		inode, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(ns, "net:["), "]"), 10, 64)
+		if err != nil {
+			continue
+		}
+		namespaces = append(namespaces, netNamespace{pid, inode})
+	}
+	return namespaces, nil
+}
+
+// NamespaceSocks returns the sockets of all protocols in every network
+// namespace except the current one, containing only those elements that
+// satisfy the accept function
+func osNamespaceSocks(accept AcceptFn) ([]SockTabEntry, error) {
+	namespaces, err := otherNamespaces()
+	if err != nil {
+		return nil, err
+	}
+	var tabs []SockTabEntry
+	for _, ns := range namespaces {
+		for _, t := range namespaceTables {
+			f, err := os.Open(path.Join("/proc", strconv.Itoa(ns.pid), "net", t.name))
+			if err != nil {
+				// the table is missing or the process is already gone
+				continue
+			}
+			tab, err := t.parse(f, accept)
+			f.Close()
+			if err != nil {
+				return nil, err
+			}
+			for i := range tab {
+				tab[i].Netns = ns.inode
+			}
+			tabs = append(tabs, tab...)
+		}
+	}
+	extractProcInfo(tabs)
+	return tabs, nil
+}
+
+// parseFibTrie returns the local IPv4 addresses of /proc/net/fib_trie, the
+// ones followed by a "/32 host LOCAL" line
+func parseFibTrie(r io.Reader) []net.IP {
+	br := bufio.NewScanner(r)
+	var ips []net.IP
+	var last net.IP
+	for br.Scan() {
+		line := strings.TrimSpace(br.Text())
+		if ip, ok := strings.CutPrefix(line, "|-- "); ok {
+			last = net.ParseIP(ip)
+			continue
+		}
+		if last != nil && strings.HasPrefix(line, "/32 host LOCAL") {
+			ips = append(ips, last.To4())
+			last = nil
+		}
+	}
+	return ips
+}
+
+// parseIfInet6 returns the addresses of /proc/net/if_inet6
+func parseIfInet6(r io.Reader) []net.IP {
+	br := bufio.NewScanner(r)
+	var ips []net.IP
+	for br.Scan() {
+		fields := strings.Fields(br.Text())
+		if len(fields) == 0 || len(fields[0]) != ipv6StrLen {
+			continue
+		}
+		ip := make(net.IP, 0, net.IPv6len)
+		for i := 0; i < ipv6StrLen; i += 2 {
+			b, err := strconv.ParseUint(fields[0][i:i+2], 16, 8)
+			if err != nil {
+				break
+			}
+			ip = append(ip, byte(b))
+		}
+		if len(ip) == net.IPv6len {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// namespaceAddrTables are the tables of /proc/<pid>/net listing the local
+// addresses of a network namespace, along with their parsers
+var namespaceAddrTables = []struct {
+	name  string
+	parse func(io.Reader) []net.IP
+}{
+	{"fib_trie", parseFibTrie},
+	{"if_inet6", parseIfInet6},
+}
+
+// NamespaceAddrs returns the local addresses of every network namespace
+// except the current one, by namespace inode
+func osNamespaceAddrs() (map[uint64][]net.IP, error) {
+	namespaces, err := otherNamespaces()
+	if err != nil {
+		return nil, err
+	}
+	addrs := make(map[uint64][]net.IP, len(namespaces))
+	for _, ns := range namespaces {
+		for _, t := range namespaceAddrTables {
+			f, err := os.Open(path.Join("/proc", strconv.Itoa(ns.pid), "net", t.name))
+			if err != nil {
+				continue
+			}
+			addrs[ns.inode] = append(addrs[ns.inode], t.parse(f)...)
+			f.Close()
+		}
+	}
+	return addrs, nil
+}
@@ -585,3 +585,25 @@ func osUDP6Socks(accept AcceptFn) ([]SockTabEntry, error) {
 	snp.Close()
 	return sktab, nil
 }
+
+// UDP-Lite, DCCP and SCTP socket tables, as well as the sockets of other
+// network namespaces, are not exposed on this platform
+func osUDPLiteSocks(accept AcceptFn) ([]SockTabEntry, error) {
+	return nil, nil
+}
+
+func osDCCPSocks(accept AcceptFn) ([]SockTabEntry, error) {
+	return nil, nil
+}
+
+func osSCTPSocks(accept AcceptFn) ([]SockTabEntry, error) {
+	return nil, nil
+}
+
+func osNamespaceSocks(accept AcceptFn) ([]SockTabEntry, error) {
+	return nil, nil
+}
+
+func osNamespaceAddrs() (map[uint64][]net.IP, error) {
+	return nil, nil
+}
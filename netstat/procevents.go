@@ -0,0 +1,77 @@
+package netstat
+
+import (
+	"sync"
+	"time"
+)
+
+// ProcEventKind is the kind of a process lifecycle event
+type ProcEventKind uint8
+
+// Process lifecycle events
+const (
+	ProcFork ProcEventKind = iota + 1
+	ProcExec
+	ProcExit
+	ProcComm
+)
+
+var procEventKinds = [...]string{
+	"unknown",
+	"fork",
+	"exec",
+	"exit",
+	"comm",
+}
+
+func (k ProcEventKind) String() string {
+	if int(k) >= len(procEventKinds) {
+		return procEventKinds[0]
+	}
+	return procEventKinds[k]
+}
+
+// ProcEvent is a process lifecycle event reported by the kernel. Parent is
+// the parent process for fork and exec events, if known
+type ProcEvent struct {
+	Kind    ProcEventKind
+	Time    time.Time
+	Process Process
+	Parent  *Process
+	// Args is the command line of exec events, read when the event is
+	// received since short lived processes may be gone by the time it's used
+	Args string
+}
+
+// procCache holds the name of each process by pid while WatchProcesses is
+// running, so the process of a socket doesn't have to be read from /proc on
+// every lookup
+var procCache = struct {
+	sync.RWMutex
+	enabled bool
+	procs   map[int]*Process
+}{procs: make(map[int]*Process)}
+
+func cachedProcess(pid int) *Process {
+	procCache.RLock()
+	defer procCache.RUnlock()
+	if !procCache.enabled {
+		return nil
+	}
+	return procCache.procs[pid]
+}
+
+func cacheProcess(p *Process) {
+	procCache.Lock()
+	defer procCache.Unlock()
+	if procCache.enabled {
+		procCache.procs[p.Pid] = p
+	}
+}
+
+// WatchProcesses subscribes to the kernel process lifecycle events. They keep
+// the process cache used by the socket lookups accurate between refreshes, and
+// are sent to events if it's not nil. Events are dropped if events is full
+func WatchProcesses(events chan<- ProcEvent) error {
+	return osWatchProcesses(events)
+}
@@ -0,0 +1,227 @@
+package netstat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path"
+	"strconv"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// proc connector constants from linux/connector.h and linux/cn_proc.h
+const (
+	cnIdxProc          = 0x1
+	cnValProc          = 0x1
+	procCnMcastListen  = 1
+	procEventFork      = 0x00000001
+	procEventExec      = 0x00000002
+	procEventComm      = 0x00000200
+	procEventExit      = 0x80000000
+	cnMsgSize          = 20
+	procEventHeaderLen = 16
+)
+
+// readProcStat returns the name and the parent pid of a process
+func readProcStat(pid int) (string, int, error) {
+	stat, err := os.ReadFile(path.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return "", 0, err
+	}
+	name := getProcName(stat)
+	// the fields after the name are: state ppid ...
+	i := bytes.LastIndex(stat, []byte(")"))
+	if i < 0 {
+		return name, 0, nil
+	}
+	fields := bytes.Fields(stat[i+1:])
+	if len(fields) < 2 {
+		return name, 0, nil
+	}
+	ppid, _ := strconv.Atoi(string(fields[1]))
+	return name, ppid, nil
+}
+
+// readProcCmdline returns the command line of a process, its arguments
+// separated by spaces
+func readProcCmdline(pid int) string {
+	cmdline, err := os.ReadFile(path.Join("/proc", strconv.Itoa(pid), "cmdline"))
+	if err != nil {
+		return ""
+	}
+	return string(bytes.ReplaceAll(bytes.TrimRight(cmdline, "\x00"), []byte{0}, []byte{' '}))
+}
+
+// processOf returns the cached process of pid, or reads it from /proc
+func processOf(pid int) *Process {
+	if p := cachedProcess(pid); p != nil {
+		return p
+	}
+	name, _, err := readProcStat(pid)
+	if err != nil {
+		return nil
+	}
+	p := &Process{pid, name}
+	cacheProcess(p)
+	return p
+}
+
+func osWatchProcesses(events chan<- ProcEvent) error {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, unix.NETLINK_CONNECTOR)
+	if err != nil {
+		return err
+	}
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{
+		Family: unix.AF_NETLINK,
+		Groups: cnIdxProc,
+		Pid:    uint32(os.Getpid()),
+	}); err != nil {
+		unix.Close(fd)
+		return err
+	}
+
+	// nlmsghdr, cn_msg and the PROC_CN_MCAST_LISTEN operation
+	msg := make([]byte, unix.NLMSG_HDRLEN+cnMsgSize+4)
+	binary.NativeEndian.PutUint32(msg[0:4], uint32(len(msg)))
+	binary.NativeEndian.PutUint16(msg[4:6], unix.NLMSG_DONE)
+	binary.NativeEndian.PutUint32(msg[12:16], uint32(os.Getpid()))
+	cn := msg[unix.NLMSG_HDRLEN:]
+	binary.NativeEndian.PutUint32(cn[0:4], cnIdxProc)
+	binary.NativeEndian.PutUint32(cn[4:8], cnValProc)
+	binary.NativeEndian.PutUint16(cn[16:18], 4)
+	binary.NativeEndian.PutUint32(cn[cnMsgSize:], procCnMcastListen)
+	if err := unix.Sendto(fd, msg, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		unix.Close(fd)
+		return err
+	}
+
+	procCache.Lock()
+	procCache.enabled = true
+	procCache.Unlock()
+
+	go readProcEvents(fd, events)
+	return nil
+}
+
+func readProcEvents(fd int, events chan<- ProcEvent) {
+	defer func() {
+		unix.Close(fd)
+		procCache.Lock()
+		procCache.enabled = false
+		procCache.procs = make(map[int]*Process)
+		procCache.Unlock()
+	}()
+	buf := make([]byte, os.Getpagesize())
+	for {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if errors.Is(err, unix.EINTR) {
+			continue
+		}
+		if errors.Is(err, unix.ENOBUFS) {
+			// events were lost, so cached processes may have exec'd or exited
+			// and their pids been reused. They are read from /proc again
+			procCache.Lock()
+			procCache.procs = make(map[int]*Process)
+			procCache.Unlock()
+			continue
+		}
+		if err != nil {
+			return
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			continue
+		}
+		for _, m := range msgs {
+			if len(m.Data) < cnMsgSize+procEventHeaderLen {
+				continue
+			}
+			ev, ok := parseProcEvent(m.Data[cnMsgSize:])
+			if !ok || events == nil {
+				continue
+			}
+			select {
+			case events <- ev:
+			default:
+			}
+		}
+	}
+}
+
+// parseProcEvent decodes a struct proc_event and updates the process cache
+func parseProcEvent(b []byte) (ProcEvent, bool) {
+	what := binary.NativeEndian.Uint32(b[0:4])
+	data := b[procEventHeaderLen:]
+	ev := ProcEvent{Time: time.Now()}
+	switch what {
+	case procEventFork:
+		if len(data) < 16 {
+			return ev, false
+		}
+		// threads share the process of their thread group
+		if binary.NativeEndian.Uint32(data[8:12]) != binary.NativeEndian.Uint32(data[12:16]) {
+			return ev, false
+		}
+		parent := processOf(int(binary.NativeEndian.Uint32(data[4:8])))
+		child := int(binary.NativeEndian.Uint32(data[12:16]))
+		ev.Kind = ProcFork
+		ev.Parent = parent
+		ev.Process = Process{Pid: child}
+		if parent != nil {
+			ev.Process.Name = parent.Name
+		}
+		cacheProcess(&Process{child, ev.Process.Name})
+	case procEventExec:
+		if len(data) < 8 {
+			return ev, false
+		}
+		pid := int(binary.NativeEndian.Uint32(data[4:8]))
+		name, ppid, err := readProcStat(pid)
+		if err != nil {
+			return ev, false
+		}
+		ev.Kind = ProcExec
+		ev.Process = Process{pid, name}
+		ev.Parent = processOf(ppid)
+		ev.Args = readProcCmdline(pid)
+		cacheProcess(&Process{pid, name})
+	case procEventComm:
+		if len(data) < 24 {
+			return ev, false
+		}
+		if binary.NativeEndian.Uint32(data[0:4]) != binary.NativeEndian.Uint32(data[4:8]) {
+			return ev, false
+		}
+		pid := int(binary.NativeEndian.Uint32(data[4:8]))
+		comm := data[8:24]
+		if i := bytes.IndexByte(comm, 0); i >= 0 {
+			comm = comm[:i]
+		}
+		ev.Kind = ProcComm
+		ev.Process = Process{pid, string(comm)}
+		cacheProcess(&Process{pid, string(comm)})
+	case procEventExit:
+		if len(data) < 8 {
+			return ev, false
+		}
+		if binary.NativeEndian.Uint32(data[0:4]) != binary.NativeEndian.Uint32(data[4:8]) {
+			return ev, false
+		}
+		pid := int(binary.NativeEndian.Uint32(data[4:8]))
+		ev.Kind = ProcExit
+		ev.Process = Process{Pid: pid}
+		if p := cachedProcess(pid); p != nil {
+			ev.Process.Name = p.Name
+		}
+		procCache.Lock()
+		delete(procCache.procs, pid)
+		procCache.Unlock()
+	default:
+		return ev, false
+	}
+	return ev, true
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package netstat
+
+import "errors"
+
+func osWatchProcesses(events chan<- ProcEvent) error {
+	return errors.New("netstat: process events are only supported on Linux")
+}
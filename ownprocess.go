@@ -0,0 +1,108 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+	"github.com/shirou/gopsutil/process"
+)
+
+// ownProcesses are the processes whose packets are left out of a live capture
+// streamed with -o - unless --keep-own-traffic is set: tcpshark, its parent
+// processes up to the leader of its session, the sshd session it runs in, and
+// the processes reading its output, such as nc in 'tcpshark -o - | nc'.
+// Capturing them would loop on the output
+var ownProcesses struct {
+	sync.RWMutex
+	pids map[uint32]bool
+	// readers are the processes reading the output pipe, once found. They're
+	// looked for during the first pipeReaderTries updates
+	readers []uint32
+	tries   int
+}
+
+// pipeReaderTries is how many times the readers of the output are looked for
+const pipeReaderTries = 10
+
+// privilegeCommands are skipped between the leader of the session of
+// tcpshark and its sshd session, as in ssh host sudo tcpshark
+var privilegeCommands = map[string]bool{"sudo": true, "su": true, "doas": true}
+
+// streamedOutput reports whether the output is written to stdout, and stdout
+// is a pipe or a socket, which may be sent over the network. The output to a
+// file or a terminal isn't captured again
+func streamedOutput() bool {
+	if generalOptions.OutFile != "-" {
+		return false
+	}
+	fi, err := os.Stdout.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&(os.ModeNamedPipe|os.ModeSocket) != 0
+}
+
+// sessionProcesses returns tcpshark, its parent processes in its session and
+// the sshd process of the session, if it's run through SSH
+func sessionProcesses() map[uint32]bool {
+	pids := map[uint32]bool{uint32(os.Getpid()): true}
+	sid := sessionID(int32(os.Getpid()))
+	inSession := true
+	for pid := int32(os.Getppid()); pid > 1; {
+		p, err := process.NewProcess(pid)
+		if err != nil {
+			break
+		}
+		name, _ := p.Name()
+		if strings.HasPrefix(name, "sshd") {
+			pids[uint32(pid)] = true
+			break
+		}
+		inSession = inSession && sid > 0 && sessionID(pid) == sid
+		if inSession {
+			pids[uint32(pid)] = true
+		} else if !privilegeCommands[name] {
+			break
+		}
+		if pid, err = p.Ppid(); err != nil {
+			break
+		}
+	}
+	return pids
+}
+
+// updateOwnProcesses looks up the processes of ownProcesses again, as the
+// reader of the output may start after tcpshark
+func updateOwnProcesses() {
+	if generalOptions.KeepOwnTraffic || generalOptions.ReadFile != "" || !streamedOutput() {
+		return
+	}
+	pids := sessionProcesses()
+	readers := ownProcesses.readers
+	if readers == nil && ownProcesses.tries < pipeReaderTries {
+		ownProcesses.tries++
+		readers = pipeReaders(os.Stdout)
+		if len(readers) > 0 {
+			log.Info().Msgf("Leaving out the packets of the processes reading the output: %v", readers)
+		}
+	}
+	for _, pid := range readers {
+		pids[pid] = true
+	}
+	ownProcesses.Lock()
+	ownProcesses.pids = pids
+	ownProcesses.readers = readers
+	ownProcesses.Unlock()
+}
+
+// ownTraffic reports whether a packet belongs to one of ownProcesses
+func ownTraffic(m *packetMetaData) bool {
+	if m.Magic != tcpSharkMagic || m.Pid == 0 {
+		return false
+	}
+	ownProcesses.RLock()
+	defer ownProcesses.RUnlock()
+	return ownProcesses.pids[m.Pid]
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// sessionID returns the session of a process, 0 if it's unknown
+func sessionID(pid int32) int {
+	sid, err := unix.Getsid(int(pid))
+	if err != nil {
+		return 0
+	}
+	return sid
+}
+
+// pipeReaders returns the other processes holding the pipe f is writing to,
+// nil if f isn't a pipe
+func pipeReaders(f *os.File) []uint32 {
+	pipe, err := os.Readlink("/proc/self/fd/" + strconv.Itoa(int(f.Fd())))
+	if err != nil || !strings.HasPrefix(pipe, "pipe:") {
+		return nil
+	}
+	fds, _ := filepath.Glob("/proc/[0-9]*/fd/*")
+	self := os.Getpid()
+	seen := make(map[uint32]bool)
+	var readers []uint32
+	for _, fd := range fds {
+		link, err := os.Readlink(fd)
+		if err != nil || link != pipe {
+			continue
+		}
+		pid, err := strconv.Atoi(filepath.Base(filepath.Dir(filepath.Dir(fd))))
+		if err != nil || pid == self || seen[uint32(pid)] {
+			continue
+		}
+		seen[uint32(pid)] = true
+		readers = append(readers, uint32(pid))
+	}
+	return readers
+}
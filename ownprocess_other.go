@@ -0,0 +1,17 @@
+//go:build !linux
+
+package main
+
+import "os"
+
+// pipeReaders returns the processes holding the pipe f is writing to. They
+// are only found on Linux
+func pipeReaders(f *os.File) []uint32 {
+	return nil
+}
+
+// sessionID returns the session of a process. Sessions are only read on
+// Linux, elsewhere only the sshd session of tcpshark is found
+func sessionID(pid int32) int {
+	return 0
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+)
+
+// tcpsharkPEN is the Private Enterprise Number of tcpshark's custom pcapng
+// blocks and options. 32473 is reserved for documentation by RFC 5612, and any
+// tool may use it, so they're only written with --experimental-blocks
+// until tcpshark has one registered
+const tcpsharkPEN = 32473
+
+// pcapng block types
+const (
+	ngBlockTypeSectionHeader        = 0x0A0D0D0A
+	ngBlockTypeInterfaceDescription = 0x00000001
+	ngBlockTypeEnhancedPacket       = 0x00000006
+	// ngBlockTypeCustom is a custom block that may be copied to new files
+	ngBlockTypeCustom = 0x40000BAD
+)
+
+// pcapng option codes
+const (
+	ngOptionEndOfOptions = 0
+	ngOptionComment      = 1
+	ngOptionSHBHardware  = 2
+	ngOptionSHBOS        = 3
+	ngOptionSHBUserAppl  = 4
+	ngOptionIfName       = 2
+	ngOptionIfTsresol    = 9
+	ngOptionIfFCSLen     = 13
+	// ngOptionCustomBinary is a custom option that may be copied to new files
+	ngOptionCustomBinary = 2989
+)
+
+// tcpshark custom block records, stored in the first 4 bytes of the data
+const (
+	customRecordProcEvent = 1
+)
+
+// ngOption is a pcapng option of any block
+type ngOption struct {
+	code  uint16
+	value []byte
+}
+
+// ngInterface is an Interface Description Block
+type ngInterface struct {
+	name     string
+	linkType layers.LinkType
+	// tsresol is the number of decimal digits of the timestamps, 6 for
+	// microseconds and 9 for nanoseconds
+	tsresol uint8
+	// comment describes the capture, such as the time stamp source
+	comment string
+	// options are more options of the interface, such as if_fcslen
+	options []ngOption
+}
+
+// ngWriter writes a pcapng section. Unlike pcapgo.NgWriter, it writes the
+// timestamp resolution of each interface, custom blocks and custom options.
+// Blocks can be written from several goroutines
+type ngWriter struct {
+	mu         sync.Mutex // guards w and interfaces
+	w          *bufio.Writer
+	interfaces []ngInterface
+}
+
+func newNgWriter(w io.Writer) (*ngWriter, error) {
+	ng := &ngWriter{w: bufio.NewWriter(w)}
+	body := make([]byte, 16)
+	binary.LittleEndian.PutUint32(body[0:4], 0x1A2B3C4D)  // byte-order magic
+	binary.LittleEndian.PutUint16(body[4:6], 1)           // major version
+	binary.LittleEndian.PutUint16(body[6:8], 0)           // minor version
+	binary.LittleEndian.PutUint64(body[8:16], ^uint64(0)) // unknown section length
+	err := ng.writeBlock(ngBlockTypeSectionHeader, body, []ngOption{
+		{ngOptionSHBHardware, []byte(runtime.GOARCH)},
+		{ngOptionSHBOS, []byte(runtime.GOOS)},
+		{ngOptionSHBUserAppl, []byte("tcpshark")},
+	})
+	return ng, err
+}
+
+// resolutionDigits returns the if_tsresol of a timestamp resolution, rounding
+// resolutions that aren't a power of 10 to the next finer one
+func resolutionDigits(r gopacket.TimestampResolution) uint8 {
+	if r.Base == 10 && r.Exponent < 0 && r.Exponent >= -9 {
+		return uint8(-r.Exponent)
+	}
+	return 9
+}
+
+// addInterface writes an Interface Description Block and returns its index
+func (ng *ngWriter) addInterface(intf ngInterface) (int, error) {
+	if intf.tsresol == 0 || intf.tsresol > 9 {
+		intf.tsresol = 9
+	}
+	body := make([]byte, 8)
+	binary.LittleEndian.PutUint16(body[0:2], uint16(intf.linkType))
+	binary.LittleEndian.PutUint32(body[4:8], 0) // no snaplen, the trailer adds to the packets
+	options := []ngOption{
+		{ngOptionIfName, []byte(intf.name)},
+		{ngOptionIfTsresol, []byte{intf.tsresol}},
+	}
+	if intf.comment != "" {
+		options = append(options, ngOption{ngOptionComment, []byte(intf.comment)})
+	}
+	options = append(options, intf.options...)
+	// the block is written and counted under the same lock, so the indexes
+	// follow the order of the blocks
+	b := encodeBlock(ngBlockTypeInterfaceDescription, body, options)
+	ng.mu.Lock()
+	defer ng.mu.Unlock()
+	if _, err := ng.w.Write(b); err != nil {
+		return 0, err
+	}
+	ng.interfaces = append(ng.interfaces, intf)
+	return len(ng.interfaces) - 1, nil
+}
+
+// writePacket writes an Enhanced Packet Block. The timestamp is written with
+// the resolution of the interface of the packet
+func (ng *ngWriter) writePacket(ci gopacket.CaptureInfo, data []byte, options []ngOption) error {
+	ng.mu.Lock()
+	count := len(ng.interfaces)
+	var tsresol uint8
+	if ci.InterfaceIndex >= 0 && ci.InterfaceIndex < count {
+		tsresol = ng.interfaces[ci.InterfaceIndex].tsresol
+	}
+	ng.mu.Unlock()
+	if ci.InterfaceIndex < 0 || ci.InterfaceIndex >= count {
+		return fmt.Errorf("interface %d doesn't exist, %d interfaces were added", ci.InterfaceIndex, count)
+	}
+	if ci.CaptureLength != len(data) {
+		return fmt.Errorf("capture length %d does not match data length %d", ci.CaptureLength, len(data))
+	}
+	ts := uint64(ci.Timestamp.UnixNano())
+	for i := tsresol; i < 9; i++ {
+		ts /= 10
+	}
+	body := make([]byte, 20, 20+len(data)+3)
+	binary.LittleEndian.PutUint32(body[0:4], uint32(ci.InterfaceIndex))
+	binary.LittleEndian.PutUint32(body[4:8], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(body[8:12], uint32(ts))
+	binary.LittleEndian.PutUint32(body[12:16], uint32(ci.CaptureLength))
+	binary.LittleEndian.PutUint32(body[16:20], uint32(max(ci.Length, ci.CaptureLength)))
+	body = append(body, data...)
+	return ng.writeBlock(ngBlockTypeEnhancedPacket, body, options)
+}
+
+// writeCustomBlock writes a pcapng custom block holding a tcpshark record
+func (ng *ngWriter) writeCustomBlock(record uint32, data []byte) error {
+	body := make([]byte, 8, 8+len(data))
+	binary.LittleEndian.PutUint32(body[0:4], tcpsharkPEN)
+	binary.BigEndian.PutUint32(body[4:8], record)
+	body = append(body, data...)
+	return ng.writeBlock(ngBlockTypeCustom, body, nil)
+}
+
+// customOption returns a custom option holding tcpshark data
+func customOption(data []byte) ngOption {
+	value := make([]byte, 4, 4+len(data))
+	binary.LittleEndian.PutUint32(value, tcpsharkPEN)
+	return ngOption{ngOptionCustomBinary, append(value, data...)}
+}
+
+// writeBlock writes a block made of body, padded to 32 bits, and options
+func (ng *ngWriter) writeBlock(blockType uint32, body []byte, options []ngOption) error {
+	b := encodeBlock(blockType, body, options)
+	ng.mu.Lock()
+	defer ng.mu.Unlock()
+	_, err := ng.w.Write(b)
+	return err
+}
+
+// encodeBlock returns the bytes of a block made of body and options
+func encodeBlock(blockType uint32, body []byte, options []ngOption) []byte {
+	length := 12 + pad4(len(body))
+	if len(options) > 0 {
+		for _, o := range options {
+			length += 4 + pad4(len(o.value))
+		}
+		length += 4 // opt_endofopt
+	}
+	b := make([]byte, 0, length)
+	b = binary.LittleEndian.AppendUint32(b, blockType)
+	b = binary.LittleEndian.AppendUint32(b, uint32(length))
+	b = append(b, body...)
+	b = append(b, make([]byte, pad4(len(body))-len(body))...)
+	if len(options) > 0 {
+		for _, o := range options {
+			b = binary.LittleEndian.AppendUint16(b, o.code)
+			b = binary.LittleEndian.AppendUint16(b, uint16(len(o.value)))
+			b = append(b, o.value...)
+			b = append(b, make([]byte, pad4(len(o.value))-len(o.value))...)
+		}
+		b = binary.LittleEndian.AppendUint32(b, ngOptionEndOfOptions)
+	}
+	return binary.LittleEndian.AppendUint32(b, uint32(length))
+}
+
+// flush writes the buffered blocks
+func (ng *ngWriter) flush() error {
+	ng.mu.Lock()
+	defer ng.mu.Unlock()
+	return ng.w.Flush()
+}
+
+// pad4 rounds n up to a multiple of 4
+func pad4(n int) int {
+	return (n + 3) &^ 3
+}
+
+// timestampResolution returns the resolution of the timestamps of a source.
+// Sources that don't tell have nanosecond timestamps
+func timestampResolution(source packetSource) gopacket.TimestampResolution {
+	if r, ok := source.(interface {
+		Resolution() gopacket.TimestampResolution
+	}); ok {
+		return r.Resolution()
+	}
+	return gopacket.TimestampResolutionNanosecond
+}
+
+// fileResolution returns the timestamp resolution of a pcap file, from its
+// magic number, or of a pcapng file, the finest if_tsresol of the interfaces
+// described before its first packet. libpcap reads both with nanosecond
+// timestamps, which is also returned if the file can't be read
+func fileResolution(fileName string) gopacket.TimestampResolution {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return gopacket.TimestampResolutionNanosecond
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	magic, err := r.Peek(4)
+	if err != nil {
+		return gopacket.TimestampResolutionNanosecond
+	}
+	switch binary.LittleEndian.Uint32(magic) {
+	case 0xA1B2C3D4, 0xD4C3B2A1:
+		return gopacket.TimestampResolutionMicrosecond
+	case ngBlockTypeSectionHeader:
+		if digits := ngFileResolution(r); digits > 0 {
+			return gopacket.TimestampResolution{Base: 10, Exponent: -int(digits)}
+		}
+	}
+	return gopacket.TimestampResolutionNanosecond
+}
+
+// ngFileResolution returns the number of decimal digits of the finest
+// if_tsresol of the interfaces described before the first packet of a pcapng
+// file, 0 if there's none
+func ngFileResolution(r io.Reader) uint8 {
+	var order binary.ByteOrder = binary.LittleEndian
+	var digits uint8
+	for {
+		head := make([]byte, 12)
+		if _, err := io.ReadFull(r, head); err != nil {
+			return digits
+		}
+		if binary.LittleEndian.Uint32(head[0:4]) == ngBlockTypeSectionHeader {
+			// the byte-order magic follows the block length
+			order = binary.LittleEndian
+			if binary.BigEndian.Uint32(head[8:12]) == 0x1A2B3C4D {
+				order = binary.BigEndian
+			}
+		}
+		blockType, length := order.Uint32(head[0:4]), order.Uint32(head[4:8])
+		if length < 16 || length%4 != 0 || length > 1<<24 {
+			return digits
+		}
+		block := make([]byte, length-12)
+		if _, err := io.ReadFull(r, block); err != nil {
+			return digits
+		}
+		switch blockType {
+		case ngBlockTypeSectionHeader:
+		case ngBlockTypeInterfaceDescription:
+			if len(block) < 8 {
+				return digits
+			}
+			// the link type is read with head, then come the snaplen, the
+			// options and the trailing block length
+			tsresol := uint8(6)
+			options := block[4 : len(block)-4]
+			for len(options) >= 4 {
+				code, size := order.Uint16(options[0:2]), int(order.Uint16(options[2:4]))
+				if code == ngOptionEndOfOptions || 4+pad4(size) > len(options) {
+					break
+				}
+				if code == ngOptionIfTsresol && size == 1 {
+					tsresol = options[4]
+				}
+				options = options[4+pad4(size):]
+			}
+			d := tsresol
+			if tsresol&0x80 != 0 || tsresol > 9 {
+				// a power of 2, kept with nanoseconds
+				d = 9
+			}
+			digits = max(digits, d)
+		default:
+			// packets and other blocks follow the interface descriptions
+			return digits
+		}
+	}
+}
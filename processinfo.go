@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/binary"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Darwin pcapng extension, written by the tcpdump of macOS and read natively
+// by Wireshark as frame.darwin.process_info
+const (
+	ngBlockTypeDarwinProcessInfo = 0x80000001
+	ngOptionDarwinProcessName    = 2
+	// ngOptionDarwinPIBID is the index of the Process Information Block of
+	// the process of a packet, PIBs being numbered in file order from 0
+	ngOptionDarwinPIBID = 0x8001
+)
+
+// darwinProcess is a process described by a Process Information Block
+type darwinProcess struct {
+	pid  uint32
+	name string
+}
+
+// darwinProcessTable numbers the processes of --metadata darwin. Indexes are
+// given while annotating, possibly from several goroutines, and the blocks are
+// written before the next packet, so they always come before the packets
+// pointing to them
+type darwinProcessTable struct {
+	sync.Mutex
+	index   map[darwinProcess]uint32
+	pending []darwinProcess
+}
+
+var darwinProcesses = &darwinProcessTable{index: make(map[darwinProcess]uint32)}
+
+// options returns the Enhanced Packet Block option pointing to the Process
+// Information Block of a packet's process, none if it's unknown
+func (t *darwinProcessTable) options(m *packetMetaData) []ngOption {
+	if m.Magic != tcpSharkMagic || (m.Pid == 0 && m.Cmd == "") {
+		return nil
+	}
+	p := darwinProcess{pid: m.Pid, name: m.Cmd}
+	t.Lock()
+	id, ok := t.index[p]
+	if !ok {
+		id = uint32(len(t.index))
+		t.index[p] = id
+		t.pending = append(t.pending, p)
+	}
+	t.Unlock()
+	value := binary.LittleEndian.AppendUint32(nil, id)
+	return []ngOption{{ngOptionDarwinPIBID, value}}
+}
+
+// write writes the Process Information Blocks of the processes seen since the
+// previous call
+func (t *darwinProcessTable) write(ng *ngWriter) {
+	t.Lock()
+	pending := t.pending
+	t.pending = nil
+	t.Unlock()
+	for _, p := range pending {
+		body := binary.LittleEndian.AppendUint32(nil, p.pid)
+		var options []ngOption
+		if p.name != "" {
+			options = append(options, ngOption{ngOptionDarwinProcessName, []byte(p.name)})
+		}
+		if err := ng.writeBlock(ngBlockTypeDarwinProcessInfo, body, options); err != nil {
+			log.Warn().Msg(err.Error())
+		}
+	}
+}
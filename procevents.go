@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+
+	"github.com/lunixbochs/struc"
+	"github.com/mosajjal/tcpshark/netstat"
+)
+
+// procEventRecord is written as a custom block for each exec and exit event
+type procEventRecord struct {
+	Timestamp    int64  `struc:"int64"` // unix nanoseconds
+	Kind         uint8  `struc:"uint8"`
+	Pid          uint32 `struc:"uint32"`
+	ParentPid    uint32 `struc:"uint32"`
+	CmdLen       uint8  `struc:"uint8,sizeof=Cmd"`
+	Cmd          string
+	ParentCmdLen uint8 `struc:"uint8,sizeof=ParentCmd"`
+	ParentCmd    string
+	ArgsLen      uint16 `struc:"uint16,sizeof=Args"` // only set for exec
+	Args         string
+}
+
+// procEvents receives the process lifecycle events while --proc-events is set
+var procEvents chan netstat.ProcEvent
+
+// packProcEvent returns the custom block data of an exec or exit event. ok is
+// false for the other events, which are not written to the capture
+func packProcEvent(ev netstat.ProcEvent) (data []byte, ok bool) {
+	if ev.Kind != netstat.ProcExec && ev.Kind != netstat.ProcExit {
+		return nil, false
+	}
+	// struc doesn't check the lengths, a longer value would wrap them
+	r := procEventRecord{
+		Timestamp: ev.Time.UnixNano(),
+		Kind:      uint8(ev.Kind),
+		Pid:       uint32(ev.Process.Pid),
+		Cmd:       truncate(ev.Process.Name, 0xFF),
+		Args:      truncate(ev.Args, 0xFFFF),
+	}
+	if ev.Parent != nil {
+		r.ParentPid = uint32(ev.Parent.Pid)
+		r.ParentCmd = truncate(ev.Parent.Name, 0xFF)
+	}
+	var b bytes.Buffer
+	if err := struc.Pack(&b, &r); err != nil {
+		return nil, false
+	}
+	return b.Bytes(), true
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// unameArch maps the machine reported by uname -m to GOARCH
+var unameArch = map[string]string{
+	"x86_64":  "amd64",
+	"amd64":   "amd64",
+	"aarch64": "arm64",
+	"arm64":   "arm64",
+	"i386":    "386",
+	"i686":    "386",
+	"armv7l":  "arm",
+}
+
+// shellQuote quotes s for a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// andFilters returns a BPF filter matching both filters, either of them
+// possibly empty
+func andFilters(a, b string) string {
+	switch {
+	case a == "":
+		return b
+	case b == "":
+		return a
+	}
+	return fmt.Sprintf("(%s) and (%s)", a, b)
+}
+
+// connectionFilter returns the BPF filter excluding a TCP connection given as
+// "client_ip client_port server_ip server_port", the format of
+// $SSH_CONNECTION
+func connectionFilter(connection string) (string, error) {
+	f := strings.Fields(connection)
+	if len(f) != 4 || net.ParseIP(f[0]) == nil || net.ParseIP(f[2]) == nil {
+		return "", fmt.Errorf("%q is not a connection such as '192.0.2.1 51000 192.0.2.2 22'", connection)
+	}
+	return fmt.Sprintf("not (host %s and tcp port %s and host %s and tcp port %s)", f[0], f[1], f[2], f[3]), nil
+}
+
+// remotePath returns --remote-binary for the remote shell. A relative path is
+// relative to the home directory of the login user
+func remotePath() string {
+	if strings.HasPrefix(generalOptions.RemoteBinary, "/") {
+		return shellQuote(generalOptions.RemoteBinary)
+	}
+	return `"$HOME"/` + shellQuote(generalOptions.RemoteBinary)
+}
+
+// remoteChecks is the shell script refusing to run --remote-binary, set in
+// $P, through sudo unless it and its directory are owned by root or the login
+// user and other users can't write them
+const remoteChecks = `for F in "$(dirname "$P")" "$P"; do
+	if [ -z "$(find "$F" -prune \( -user 0 -o -user "$(id -u)" \) ! -perm -020 ! -perm -002)" ]; then
+		echo "tcpshark: $F has to be owned by root or $(id -un) and not writable by other users" >&2
+		exit 1
+	fi
+done`
+
+// ssh runs a command on the --remote host with the local ssh binary. The
+// host follows --, so a value starting with - isn't taken for an ssh option
+func ssh(command string) *exec.Cmd {
+	cmd := exec.Command("ssh", "-o", "BatchMode=yes", "--", generalOptions.Remote, command)
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+// deployRemote copies this binary to --remote-binary, if the remote host has
+// the same OS and architecture and doesn't have the same binary already.
+// Otherwise tcpshark has to be there already
+func deployRemote() error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	binary, err := os.Open(self)
+	if err != nil {
+		return err
+	}
+	defer binary.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, binary); err != nil {
+		return err
+	}
+	if _, err := binary.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	// the first line is the OS and the architecture, the second one the
+	// SHA-256 of the binary already there, if any
+	out, err := ssh(fmt.Sprintf(`uname -sm; P=%s; (sha256sum "$P" || shasum -a 256 "$P") 2>/dev/null | cut -d' ' -f1`, remotePath())).Output()
+	if err != nil {
+		return fmt.Errorf("%s: %w", generalOptions.Remote, err)
+	}
+	lines := strings.Split(string(out), "\n")
+	f := strings.Fields(lines[0])
+	if len(f) != 2 || strings.ToLower(f[0]) != runtime.GOOS || unameArch[f[1]] != runtime.GOARCH {
+		log.Warn().Msgf("%s runs %s, not deploying this %s/%s binary. %s has to be there already", generalOptions.Remote, strings.TrimSpace(lines[0]), runtime.GOOS, runtime.GOARCH, generalOptions.RemoteBinary)
+		return nil
+	}
+	if len(lines) > 1 && strings.TrimSpace(lines[1]) == hex.EncodeToString(h.Sum(nil)) {
+		log.Info().Msgf("%s:%s is already this binary", generalOptions.Remote, generalOptions.RemoteBinary)
+		return nil
+	}
+
+	// the binary is only readable and writable by the login user, since it's
+	// run by root
+	cmd := ssh(fmt.Sprintf(`umask 077; P=%s; mkdir -p "$(dirname "$P")" && cat > "$P.tmp" && chmod 700 "$P.tmp" && mv "$P.tmp" "$P"`, remotePath()))
+	cmd.Stdin = binary
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("deploying tcpshark to %s:%s: %w", generalOptions.Remote, generalOptions.RemoteBinary, err)
+	}
+	log.Info().Msgf("Deployed tcpshark to %s:%s", generalOptions.Remote, generalOptions.RemoteBinary)
+	return nil
+}
+
+// captureRemote runs tcpshark on the --remote host with args, through sudo
+// unless logging in as root, and writes its output to --outfile. The SSH
+// session of the capture is excluded from it
+func captureRemote(args []string) {
+	if err := deployRemote(); err != nil {
+		log.Fatal().Msg(err.Error())
+	}
+	var quoted []string
+	for _, arg := range args {
+		quoted = append(quoted, shellQuote(arg))
+	}
+	// $SSH_CONNECTION is expanded by the remote shell, sudo doesn't keep it
+	script := fmt.Sprintf("P=%s\n%s\n"+`S=; [ "$(id -u)" = 0 ] || S="sudo -n"; exec $S "$P" -o - --exclude-connection "$SSH_CONNECTION" %s`,
+		remotePath(), remoteChecks, strings.Join(quoted, " "))
+
+	var output *os.File
+	if generalOptions.OutFile == "-" {
+		output = os.Stdout
+	} else {
+		f, err := os.OpenFile(string(generalOptions.OutFile), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+		if err != nil {
+			log.Fatal().Msg(err.Error())
+		}
+		defer f.Close()
+		output = f
+	}
+	cmd := ssh(script)
+	cmd.Stdout = output
+	log.Info().Msgf("Capturing on %s", generalOptions.Remote)
+	if err := cmd.Run(); err != nil {
+		log.Fatal().Msgf("%s: %s", generalOptions.Remote, err)
+	}
+}
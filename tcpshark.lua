@@ -1,6 +1,27 @@
 tcpshark = Proto("TCPShark", "TCPShark data")
 
+-- TRAILER_MAGIC starts the TLV trailer, TCPSHARK_MAGIC the records of the
+-- fixed trailer written by older versions: the pid, the command and the
+-- arguments, followed by the socket inode and cookie in the last versions
+-- before the TLV trailer, which kept the same magic
+local TRAILER_MAGIC = 0xA1BFF3D7
 local TCPSHARK_MAGIC = 0xA1BFF3D4
+-- with --metadata inventory, the trailer only holds the index of the process
+-- in the inventory, written as packets of a DLT_USER0 interface
+local INVENTORY_MAGIC = 0xA1BFF3D6
+
+-- TLV trailer field types
+local TLV_FLOW = 0
+local TLV_PID = 1
+local TLV_CMD = 2
+local TLV_ARGS = 3
+local TLV_INODE = 4
+local TLV_COOKIE = 5
+local TLV_UID = 6
+local TLV_CGROUP = 7
+local TLV_DIRECTION = 8
+local TLV_SOURCE = 9
+local TLV_INDEX = 10
 
 local fields = {}
 
@@ -8,42 +29,329 @@ fields.magic   = ProtoField.uint32("tcpshark.magic", "Magic", base.HEX)
 fields.pid     = ProtoField.int32("tcpshark.pid", "PID", base.DEC)
 fields.Cmd = ProtoField.string("tcpshark.Cmd", "Cmd", base.ASCII)
 fields.Args = ProtoField.string("tcpshark.Args", "Args", base.ASCII)
+fields.inode   = ProtoField.uint64("tcpshark.inode", "Socket inode", base.DEC)
+fields.cookie  = ProtoField.uint64("tcpshark.cookie", "Socket cookie", base.HEX)
+fields.index   = ProtoField.uint32("tcpshark.index", "Inventory index", base.DEC)
+fields.user    = ProtoField.string("tcpshark.user", "User", base.ASCII)
+fields.cgroup  = ProtoField.string("tcpshark.cgroup", "Cgroup", base.ASCII)
+fields.start   = ProtoField.absolute_time("tcpshark.start", "Start time", base.LOCAL)
+fields.version = ProtoField.uint8("tcpshark.version", "Trailer version", base.DEC)
+fields.uid     = ProtoField.uint32("tcpshark.uid", "UID", base.DEC)
+fields.direction = ProtoField.uint8("tcpshark.direction", "Direction", base.DEC,
+  { [0] = "Unknown", [1] = "Outgoing", [2] = "Incoming" })
+fields.source  = ProtoField.uint8("tcpshark.source", "Attributed by", base.DEC,
+  { [0] = "Nothing", [1] = "Socket table", [2] = "eBPF", [3] = "Journal",
+    [4] = "First fragment", [5] = "Cgroup", [6] = "Kernel tunnel", [7] = "Socket cookie" })
 
 tcpshark.fields = fields
 
-function tcpshark.dissector(buffer, pinfo, tree)
+-- inventory maps the inventory indexes to their process. It's filled as the
+-- inventory packets are dissected, which come before the packets referencing
+-- them
+local inventory = {}
+
+-- init empties the inventory when a capture file is opened or reloaded, so
+-- the indexes of the previous file aren't resolved with its processes
+function tcpshark.init()
+  inventory = {}
+end
 
-  -- for now only IP packets are supported
-  eth_header_protocol = buffer(12 ,2):uint()
-  if eth_header_protocol ~= 0x800 then
+-- add_process adds the fields of a process of the inventory
+local function add_process(subtree, index)
+  local p = inventory[index]
+  subtree:add(fields.index, index)
+  if p == nil then
     return
   end
+  subtree:add(fields.Cmd, p.cmd)
+  subtree:add(fields.Args, p.args)
+  subtree:add(fields.user, p.user)
+  subtree:add(fields.cgroup, p.cgroup)
+  if p.start.secs ~= 0 then
+    subtree:add(fields.start, p.start)
+  end
+end
+
+tcpshark_inventory = Proto("TCPSharkInventory", "TCPShark process inventory")
+
+function tcpshark_inventory.dissector(buffer, pinfo, tree)
+  if buffer:len() < 9 or buffer(0, 4):uint() ~= INVENTORY_MAGIC then
+    return 0
+  end
+  pinfo.cols.protocol = "TCPShark"
+  local count = buffer(5, 4):uint()
+  local kind = "new processes"
+  if buffer(4, 1):uint() ~= 0 then
+    kind = "all processes"
+  end
+  pinfo.cols.info = string.format("Process inventory, %d %s", count, kind)
+  local subtree = tree:add(tcpshark_inventory, buffer(), string.format("TCPShark process inventory, %d %s", count, kind))
+  local offset = 9
+  for _ = 1, count do
+    local index = buffer(offset, 4):uint()
+    local pid = buffer(offset+4, 4):uint()
+    local start = buffer(offset+8, 8):int64()
+    offset = offset + 16
+    local cmd = buffer(offset+1, buffer(offset, 1):uint()):string()
+    offset = offset + 1 + buffer(offset, 1):uint()
+    local args = buffer(offset+2, buffer(offset, 2):uint()):string()
+    offset = offset + 2 + buffer(offset, 2):uint()
+    local user = buffer(offset+1, buffer(offset, 1):uint()):string()
+    offset = offset + 1 + buffer(offset, 1):uint()
+    local cgroup = buffer(offset+2, buffer(offset, 2):uint()):string()
+    offset = offset + 2 + buffer(offset, 2):uint()
+    local ms = start:tonumber()
+    inventory[index] = { pid = pid, cmd = cmd, args = args, user = user, cgroup = cgroup,
+      start = NSTime(math.floor(ms / 1000), (ms % 1000) * 1000000) }
+    local process = subtree:add(tcpshark, buffer(), string.format("%d: %s, pid: %d", index, cmd, pid))
+    process:add(fields.pid, pid)
+    add_process(process, index)
+  end
+  return buffer:len()
+end
+
+local wtap_encap = DissectorTable.get("wtap_encap")
+wtap_encap:add((wtap_encaps or wtap).USER0, tcpshark_inventory)
+
+-- the fixed trailer of older versions follows the outermost IP packet, so
+-- it's found from the IP header whatever the link type: Ethernet, Linux
+-- cooked, loopback or raw IP
+local ip_len_field = Field.new("ip.len")
+local ipv6_plen_field = Field.new("ipv6.plen")
+
+-- trailer_offset returns where the outermost IP packet of the frame ends
+local function trailer_offset()
+  local offset = nil
+  local ip_len = ip_len_field()
+  if ip_len then
+    -- ip.len is 2 bytes into the IPv4 header and counts the header
+    offset = ip_len.offset - 2 + ip_len.value
+  end
+  local ipv6_plen = ipv6_plen_field()
+  if ipv6_plen and (offset == nil or ipv6_plen.offset < ip_len.offset) then
+    -- ipv6.plen is 4 bytes into the 40 bytes IPv6 header
+    offset = ipv6_plen.offset - 4 + 40 + ipv6_plen.value
+  end
+  return offset
+end
+
+-- with --metadata options, the frame is untouched and each record is a packet
+-- comment
+local comment_field = Field.new("frame.comment")
+
+-- dissect_comments adds the records written as packet comments
+local function dissect_comments(buffer, tree)
+  for _, comment in ipairs({ comment_field() }) do
+    local title, pid, inode, cookie, rest = string.match(tostring(comment.value),
+      "^(tcpshark[%w ]*): pid=(%d+) inode=(%d+) cookie=0x(%x+) cmd=(.*)$")
+    if title then
+      local cmd, args = string.match(rest, "^(.-) args=(.*)$")
+      if cmd == nil then
+        cmd = rest
+      end
+      title = title:sub(1, 1):upper() .. title:sub(2)
+      local subtree = tree:add(tcpshark, buffer(), string.format("%s, pid: %s", title, pid))
+      subtree:add(fields.pid, tonumber(pid))
+      subtree:add(fields.Cmd, cmd)
+      subtree:add(fields.Args, args or "")
+      if inode ~= "0" then
+        subtree:add(fields.inode, UInt64.fromdec(inode))
+      end
+      if cookie ~= "0" then
+        subtree:add(fields.cookie, UInt64.fromhex(cookie))
+      end
+    end
+  end
+end
+
+-- dissect_tlv adds the records of the TLV trailer between start and stop,
+-- the footer excluded
+local function dissect_tlv(buffer, tree, start, stop)
+  local subtree = nil
+  tree:add(fields.version, buffer(start+4, 1))
+  local offset = start + 5
+  while offset + 3 <= stop do
+    local t = buffer(offset, 1):uint()
+    local length = buffer(offset+1, 2):uint()
+    if offset + 3 + length > stop then
+      return
+    end
+    local value = buffer(offset+3, length)
+    if t == TLV_FLOW then
+      -- a tunnelled packet carries a second record for its inner flow
+      local title = "Tcpshark"
+      if length > 0 and value:uint() > 0 then
+        title = "Tcpshark inner flow"
+      end
+      subtree = tree:add(tcpshark, buffer(start, stop+4-start), title)
+    elseif subtree ~= nil then
+      if t == TLV_PID then
+        subtree:add(fields.pid, value)
+        subtree:append_text(string.format(", pid: %d", value:uint()))
+      elseif t == TLV_CMD then
+        subtree:add(fields.Cmd, value)
+      elseif t == TLV_ARGS then
+        subtree:add(fields.Args, value)
+      elseif t == TLV_INODE and value:uint64() ~= UInt64(0) then
+        subtree:add(fields.inode, value)
+      elseif t == TLV_COOKIE and value:uint64() ~= UInt64(0) then
+        subtree:add(fields.cookie, value)
+      elseif t == TLV_UID then
+        subtree:add(fields.uid, value)
+      elseif t == TLV_CGROUP then
+        subtree:add(fields.cgroup, value)
+      elseif t == TLV_DIRECTION then
+        subtree:add(fields.direction, value)
+      elseif t == TLV_SOURCE then
+        subtree:add(fields.source, value)
+      elseif t == TLV_INDEX then
+        add_process(subtree, value:uint())
+      end
+      -- unknown fields are skipped
+    end
+    offset = offset + 3 + length
+  end
+end
+
+-- dissect_fixed adds the records of the fixed trailer of older versions
+local function dissect_fixed(buffer, tree, start)
+  local trailerlength = buffer:len() - start
+  local trailer = buffer(start, trailerlength)
+
+  -- a tunnelled packet carries a second record for its inner flow
+  local offset = 0
+  local record = 0
+  while trailerlength - offset >= 11 do
+    -- simple sanity check with the magic number
+    local magic = trailer(offset, 4):uint()
+    if(magic ~= TCPSHARK_MAGIC) then
+      return
+    end
+
+    local pid = trailer(offset+4, 4):uint()
+    local cmdLen = trailer(offset+8, 1):uint()
+    if offset + 11 + cmdLen > trailerlength then
+      return
+    end
+    local argsLen = trailer(offset+9+cmdLen, 2):uint()
+    if offset + 11 + cmdLen + argsLen > trailerlength then
+      return
+    end
+
+    local title = "Tcpshark"
+    if record > 0 then
+      title = "Tcpshark inner flow"
+    end
+    local subtree = tree:add(tcpshark, buffer(), string.format("%s, pid: %d", title, pid))
+    subtree:add(fields.pid, pid)
+    subtree:add(fields.Cmd, trailer(offset+9, cmdLen))
+    subtree:add(fields.Args, trailer(offset+11+cmdLen, argsLen):string())
+    offset = offset + 11 + cmdLen + argsLen
+
+    -- the records of the first versions end with the command line, followed
+    -- by the next record or at most the 4 bytes of the FCS. The later ones
+    -- have 16 more bytes for the inode and the cookie
+    if trailerlength - offset >= 16 and trailer(offset, 4):uint() ~= TCPSHARK_MAGIC then
+      local inode = trailer(offset, 8)
+      if inode:uint64() ~= UInt64(0) then
+        subtree:add(fields.inode, inode)
+      end
+      local cookie = trailer(offset+8, 8)
+      if cookie:uint64() ~= UInt64(0) then
+        subtree:add(fields.cookie, cookie)
+      end
+      offset = offset + 16
+    end
+    record = record + 1
+  end
+end
 
-  -- ethernet header is always 14 bytes, and after 2 bytes into IP header, you'll have IP packet's total length
-  local ethernet_header_size = 14
-  local iplen = buffer(16 ,2):uint()
+-- find_tlv returns where the TLV trailer ending a buffer starts and where its
+-- footer starts. The footer holds the length of the trailer, and Ethernet
+-- frames end with 4 more bytes for the FCS
+local function find_tlv(buffer)
   local framelen = buffer:len()
-  local trailerlength = framelen - ethernet_header_size - iplen
+  for _, stop in ipairs({ framelen, framelen - 4 }) do
+    if stop >= 9 then
+      local start = stop - buffer(stop-4, 4):uint()
+      if start >= 0 and start + 9 <= stop and buffer(start, 4):uint() == TRAILER_MAGIC then
+        return start, stop - 4
+      end
+    end
+  end
+  return nil
+end
 
-  -- -4: skip the FCS
-  local trailer = buffer(iplen+ethernet_header_size ,trailerlength )
+-- find_fixed returns where the fixed trailer of older versions starts in a
+-- buffer, searching from start, or nil if there's none
+local function find_fixed(buffer, start)
+  local framelen = buffer:len()
+  while start + 4 <= framelen and buffer(start, 4):uint() ~= TCPSHARK_MAGIC do
+    start = start + 1
+  end
+  if start + 11 > framelen then
+    return nil
+  end
+  return start
+end
 
-  -- simple sanity check with the magic number
-  local magic = trailer(0, 4):uint()
-  if(magic ~= TCPSHARK_MAGIC) then
-    return
+-- heuristic dissects the trailer of an Ethernet frame, which Wireshark hands
+-- over after the payload and the padding
+local function heuristic(buffer, pinfo, tree)
+  local start, stop = find_tlv(buffer)
+  if start ~= nil then
+    dissect_tlv(buffer, tree, start, stop)
+    return true
+  end
+  start = find_fixed(buffer, 0)
+  if start == nil then
+    return false
   end
+  dissect_fixed(buffer, tree, start)
+  return true
+end
 
-  local pid = trailer(4, 4):uint()
+-- field extractors are filled even without a tree, so the postdissector
+-- doesn't need all fields. eth.dst at the start of the frame tells Ethernet
+-- frames, whose trailer is left to the heuristic
+local eth_dst_field = Field.new("eth.dst")
 
-  local subtree = tree:add(tcpshark, buffer(), string.format("Tcpshark, pid: %d",pid))
-  subtree:add(fields.pid, pid)
-  local cmdLen =  trailer(8, 1):uint()
-  subtree:add(fields.Cmd, trailer(9,cmdLen))
-  local argsLen = trailer(9+cmdLen, 2):uint()
-  -- subtree:add(fields.ArgsLen, trailer(9+cmdLen,argsLen)) 
-  local args = trailer(11+cmdLen, argsLen):string()
-  subtree:add(fields.Args, args)
+local function is_ethernet()
+  local eth_dst = eth_dst_field()
+  return eth_dst ~= nil and eth_dst.offset == 0
+end
+
+-- the postdissector handles packet comments, and the trailer of the other
+-- link types and of truncated Ethernet frames, which Wireshark doesn't hand
+-- over to the heuristic
+function tcpshark.dissector(buffer, pinfo, tree)
+  dissect_comments(buffer, tree)
+  if is_ethernet() and buffer:reported_len() == buffer:len() then
+    return
+  end
+  local start, stop = find_tlv(buffer)
+  if start ~= nil then
+    dissect_tlv(buffer, tree, start, stop)
+    return
+  end
+
+  -- the fixed trailer follows the IP packet, and the trailer of another tool,
+  -- so it's found by its magic number
+  start = trailer_offset()
+  if start == nil then
+    return
+  end
+  -- truncated packets only miss the end of their IP packet, the trailer is
+  -- right after the captured bytes
+  start = start - (buffer:reported_len() - buffer:len())
+  if start < 0 then
+    return
+  end
+  start = find_fixed(buffer, start)
+  if start ~= nil then
+    dissect_fixed(buffer, tree, start)
+  end
 end
 
+tcpshark:register_heuristic("eth.trailer", heuristic)
 register_postdissector(tcpshark)
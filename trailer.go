@@ -3,10 +3,14 @@ package main
 import (
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"net"
+	"strings"
+	"sync"
 
 	"github.com/gopacket/gopacket"
 	"github.com/gopacket/gopacket/layers"
+	"github.com/rs/zerolog/log"
 )
 
 // EthernetBroadcast is the broadcast MAC address used by Ethernet.
@@ -75,13 +79,248 @@ func (e *EthernetWithTrailer) SerializeTo(b gopacket.SerializeBuffer, opts gopac
 		return err
 	}
 	copy(trailer, e.Trailer)
-	// todo: some of this gets gobbled up as framecheck sequence, putting a 4 byte 0 in the trailer to avoid that
-	checksum, err := b.AppendBytes(4)
+	// Ethernet is the outermost layer, so the buffer holds the whole frame
+	fcs := appendFCS(nil, b.Bytes())
+	checksum, err := b.AppendBytes(len(fcs))
 	if err != nil {
 		return err
 	}
-	copy(checksum, lotsOfZeros[:])
+	copy(checksum, fcs)
 	return nil
 }
 
 var lotsOfZeros [1024]byte
+
+// hasFCS reports whether an Ethernet frame ends with a valid frame check
+// sequence
+func hasFCS(frame []byte) bool {
+	if len(frame) < 64 {
+		return false
+	}
+	n := len(frame) - 4
+	return crc32.ChecksumIEEE(frame[:n]) == binary.LittleEndian.Uint32(frame[n:])
+}
+
+// appendFCS appends the FCS of an Ethernet frame to b, as selected by --fcs:
+// its CRC32, 4 zero bytes, or nothing
+func appendFCS(b, frame []byte) []byte {
+	switch generalOptions.FCS {
+	case "crc":
+		return binary.LittleEndian.AppendUint32(b, crc32.ChecksumIEEE(frame))
+	case "none":
+		return b
+	}
+	return append(b, lotsOfZeros[:4]...)
+}
+
+// fcsOptions returns the if_fcslen option of the interfaces of a link type,
+// telling readers whether the frames end with an FCS. Zero bytes aren't a
+// real FCS, so readers are left to guess, and so are they about the untouched
+// frames of --metadata options and darwin
+func fcsOptions(linkType layers.LinkType) []ngOption {
+	if linkType != layers.LinkTypeEthernet || generalOptions.Metadata == "options" || generalOptions.Metadata == "darwin" {
+		return nil
+	}
+	switch generalOptions.FCS {
+	case "crc":
+		return []ngOption{{ngOptionIfFCSLen, []byte{4}}}
+	case "none":
+		return []ngOption{{ngOptionIfFCSLen, []byte{0}}}
+	}
+	return nil
+}
+
+// passthroughFrame returns the original bytes of a packet, VLAN tags, padding
+// and trailers of other tools included, followed by the trailer. The FCS of an
+// Ethernet frame, if it had a valid one, is replaced by the one of --fcs
+func passthroughFrame(packet []byte, ethernet, truncated bool, trailer []byte) []byte {
+	frame := make([]byte, 0, len(packet)+len(trailer)+4)
+	if !ethernet {
+		frame = append(frame, packet...)
+		return append(frame, trailer...)
+	}
+	// the FCS of a truncated frame is missing anyway
+	if !truncated && hasFCS(packet) {
+		packet = packet[:len(packet)-4]
+	}
+	frame = append(frame, packet...)
+	frame = append(frame, trailer...)
+	return appendFCS(frame, frame)
+}
+
+// metadataOptions returns the Enhanced Packet Block options of --metadata
+// options: a custom option holding the same records as the trailer, for
+// programs, and a comment per record, which Wireshark and the dissector read.
+// Packets without a transport layer get none
+func metadataOptions(records ...*packetMetaData) []ngOption {
+	var options []ngOption
+	for i, m := range records {
+		if m == nil || m.Magic != tcpSharkMagic {
+			continue
+		}
+		title := "tcpshark"
+		if i > 0 {
+			title = "tcpshark inner flow"
+		}
+		comment := fmt.Sprintf("%s: pid=%d inode=%d cookie=0x%x cmd=%s", title, m.Pid, m.Inode, m.Cookie, m.Cmd)
+		if m.Args != "" {
+			comment += " args=" + m.Args
+		}
+		// options are at most 65535 bytes long
+		if len(comment) > 0xFFFF {
+			comment = comment[:0xFFFF]
+		}
+		options = append(options, ngOption{ngOptionComment, []byte(comment)})
+	}
+	if len(options) == 0 {
+		return nil
+	}
+	if !generalOptions.CustomBlocks {
+		return options
+	}
+	data := packTrailer(records...)
+	if len(data) > 0xFFFF-4 {
+		log.Warn().Msgf("the metadata of a packet is %d bytes long, too long for a pcapng option", len(data))
+	} else {
+		options = append([]ngOption{customOption(data)}, options...)
+	}
+	return options
+}
+
+// a trailer starts with tcpSharkTrailerMagic and trailerVersion, followed by
+// type-length-value fields, and ends with its length as a uint32, so it can be
+// found from the end of the frame. Each record starts with a tlvFlow field.
+// Dissectors skip the fields they don't know, so fields can be added without
+// a new version. Everything is big-endian
+const (
+	tcpSharkTrailerMagic = 0xA1BFF3D7
+	trailerVersion       = 1
+)
+
+// trailer field types
+const (
+	tlvFlow      = 0  // uint8, 0 for the packet, 1 for the inner flow of a tunnel
+	tlvPid       = 1  // uint32
+	tlvCmd       = 2  // string
+	tlvArgs      = 3  // string
+	tlvInode     = 4  // uint64
+	tlvCookie    = 5  // uint64
+	tlvUID       = 6  // uint32
+	tlvCgroup    = 7  // string
+	tlvDirection = 8  // uint8, 1 outgoing, 2 incoming
+	tlvSource    = 9  // uint8, how the packet was attributed
+	tlvIndex     = 10 // uint32, index of the process in the inventory
+)
+
+// trailerFieldNames are the fields that can be picked with --fields
+var trailerFieldNames = map[string]uint8{
+	"pid":       tlvPid,
+	"cmd":       tlvCmd,
+	"args":      tlvArgs,
+	"inode":     tlvInode,
+	"cookie":    tlvCookie,
+	"uid":       tlvUID,
+	"cgroup":    tlvCgroup,
+	"direction": tlvDirection,
+	"source":    tlvSource,
+}
+
+// trailerFields are the fields written to the trailer
+var trailerFields = map[uint8]bool{}
+
+// parseTrailerFields selects the fields of the trailer from a comma separated
+// list, or from the verbosity if it's empty, and returns the verbosity the
+// fields need from lookupProcess
+func parseTrailerFields(list string, verbosity uint8) (map[uint8]bool, uint8, error) {
+	if list == "" {
+		list = "pid,inode,cookie"
+		if verbosity >= 1 {
+			list += ",cmd"
+		}
+		if verbosity >= 2 {
+			list += ",args"
+		}
+	}
+	fields := make(map[uint8]bool)
+	for _, name := range strings.Split(list, ",") {
+		t, ok := trailerFieldNames[strings.TrimSpace(name)]
+		if !ok {
+			return nil, 0, fmt.Errorf("unknown trailer field %q", name)
+		}
+		fields[t] = true
+	}
+	switch {
+	case fields[tlvArgs]:
+		verbosity = 2
+	case fields[tlvCmd]:
+		verbosity = 1
+	default:
+		verbosity = 0
+	}
+	return fields, verbosity, nil
+}
+
+// processCgroups caches the cgroup of the processes, read from /proc
+var processCgroups sync.Map
+
+// pruneProcessCgroups forgets the cgroups of the processes that have no socket
+// left, so processCgroups doesn't grow with every pid of a long capture
+func pruneProcessCgroups(live map[uint32]bool) {
+	processCgroups.Range(func(k, _ any) bool {
+		if !live[k.(inventoryKey).pid] {
+			processCgroups.Delete(k)
+		}
+		return true
+	})
+}
+
+// packTrailer returns the trailer holding the selected fields of records.
+// Records of packets without a transport layer are left out
+func packTrailer(records ...*packetMetaData) []byte {
+	b := binary.BigEndian.AppendUint32(nil, tcpSharkTrailerMagic)
+	b = append(b, trailerVersion)
+	field := func(t uint8, value []byte) {
+		if !trailerFields[t] && t != tlvFlow && t != tlvIndex {
+			return
+		}
+		// values are cut to fit their uint16 length
+		if len(value) > 0xFFFF {
+			value = value[:0xFFFF]
+		}
+		b = append(b, t)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(value)))
+		b = append(b, value...)
+	}
+	for i, m := range records {
+		if m == nil || m.Magic != tcpSharkMagic {
+			continue
+		}
+		field(tlvFlow, []byte{uint8(i)})
+		field(tlvPid, binary.BigEndian.AppendUint32(nil, m.Pid))
+		if m.Index != 0 {
+			// the command and arguments are in the inventory
+			field(tlvIndex, binary.BigEndian.AppendUint32(nil, m.Index))
+		} else {
+			field(tlvCmd, []byte(m.Cmd))
+			field(tlvArgs, []byte(m.Args))
+		}
+		field(tlvInode, binary.BigEndian.AppendUint64(nil, m.Inode))
+		field(tlvCookie, binary.BigEndian.AppendUint64(nil, m.Cookie))
+		field(tlvUID, binary.BigEndian.AppendUint32(nil, m.UID))
+		if trailerFields[tlvCgroup] {
+			cgroup := m.Cgroup
+			if cgroup == "" && m.Pid != 0 {
+				key := inventoryKey{m.Pid, m.Cmd}
+				cached, ok := processCgroups.Load(key)
+				if !ok {
+					cached, _ = processCgroups.LoadOrStore(key, processCgroup(m.Pid))
+				}
+				cgroup = cached.(string)
+			}
+			field(tlvCgroup, []byte(cgroup))
+		}
+		field(tlvDirection, []byte{m.Direction})
+		field(tlvSource, []byte{m.Source})
+	}
+	return binary.BigEndian.AppendUint32(b, uint32(len(b)+4))
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+)
+
+// trailerRecords parses a trailer, found from the end of b, into its records,
+// each a map of the values of its fields by type. It returns the bytes before
+// the trailer
+func trailerRecords(t *testing.T, b []byte) ([]byte, []map[uint8][]byte) {
+	t.Helper()
+	if len(b) < 9 {
+		t.Fatalf("%d bytes are too short for a trailer", len(b))
+	}
+	length := int(binary.BigEndian.Uint32(b[len(b)-4:]))
+	if length < 9 || length > len(b) {
+		t.Fatalf("trailer length %d out of %d bytes", length, len(b))
+	}
+	before, trailer := b[:len(b)-length], b[len(b)-length:len(b)-4]
+	if binary.BigEndian.Uint32(trailer[0:4]) != tcpSharkTrailerMagic || trailer[4] != trailerVersion {
+		t.Fatalf("trailer starts with % x", trailer[:5])
+	}
+	var records []map[uint8][]byte
+	tlv := trailer[5:]
+	for len(tlv) > 0 {
+		if len(tlv) < 3 {
+			t.Fatalf("truncated field % x", tlv)
+		}
+		typ, size := tlv[0], int(binary.BigEndian.Uint16(tlv[1:3]))
+		if 3+size > len(tlv) {
+			t.Fatalf("field %d is %d bytes long, %d left", typ, size, len(tlv)-3)
+		}
+		if typ == tlvFlow {
+			records = append(records, map[uint8][]byte{})
+		} else if len(records) == 0 {
+			t.Fatalf("field %d before the first record", typ)
+		}
+		records[len(records)-1][typ] = tlv[3 : 3+size]
+		tlv = tlv[3+size:]
+	}
+	return before, records
+}
+
+// serialize returns the bytes of a frame made of ls
+func serialize(t *testing.T, ls ...gopacket.SerializableLayer) []byte {
+	t.Helper()
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, ls...); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// withFCS returns frame followed by its FCS
+func withFCS(frame []byte) []byte {
+	return binary.LittleEndian.AppendUint32(append([]byte(nil), frame...), crc32.ChecksumIEEE(frame))
+}
+
+func TestPassthroughFrame(t *testing.T) {
+	src, dst := net.HardwareAddr{2, 0, 0, 0, 0, 1}, net.HardwareAddr{2, 0, 0, 0, 0, 2}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.IP{10, 0, 0, 1}, DstIP: net.IP{10, 0, 0, 2}}
+	tcp := &layers.TCP{SrcPort: 40000, DstPort: 80, Seq: 1, ACK: true, PSH: true, Window: 512}
+	if err := tcp.SetNetworkLayerForChecksum(ip); err != nil {
+		t.Fatal(err)
+	}
+	payload := gopacket.Payload(bytes.Repeat([]byte("tcpshark"), 8))
+
+	vlan := serialize(t,
+		&layers.Ethernet{SrcMAC: src, DstMAC: dst, EthernetType: layers.EthernetTypeDot1Q},
+		&layers.Dot1Q{VLANIdentifier: 100, Type: layers.EthernetTypeIPv4},
+		ip, tcp, payload)
+	// a bare ACK is padded to the 60 bytes of the smallest frame
+	ack := &layers.TCP{SrcPort: 40000, DstPort: 80, Seq: 1, ACK: true, Window: 512}
+	if err := ack.SetNetworkLayerForChecksum(ip); err != nil {
+		t.Fatal(err)
+	}
+	padded := serialize(t, &layers.Ethernet{SrcMAC: src, DstMAC: dst, EthernetType: layers.EthernetTypeIPv4}, ip, ack)
+	padded = append(padded, lotsOfZeros[:60-len(padded)]...)
+	plain := serialize(t, &layers.Ethernet{SrcMAC: src, DstMAC: dst, EthernetType: layers.EthernetTypeIPv4}, ip, tcp, payload)
+	// a timestamp trailer appended by a packet broker after the FCS
+	other := append(withFCS(plain), 0x5a, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07)
+
+	tests := []struct {
+		name      string
+		packet    []byte
+		truncated bool
+		original  []byte // the bytes expected before the trailer
+	}{
+		{"VLAN tagged", vlan, false, vlan},
+		{"padded", padded, false, padded},
+		{"valid FCS", withFCS(plain), false, plain},
+		{"trailer of another tool", other, false, other},
+		{"truncated", withFCS(plain), true, withFCS(plain)},
+	}
+
+	fcs := generalOptions.FCS
+	fields := trailerFields
+	t.Cleanup(func() {
+		generalOptions.FCS = fcs
+		trailerFields = fields
+	})
+	generalOptions.FCS = "crc"
+	trailerFields = map[uint8]bool{tlvPid: true, tlvCmd: true}
+	trailer := packTrailer(&packetMetaData{Magic: tcpSharkMagic, Pid: 42, Cmd: "curl"})
+
+	for _, tt := range tests {
+		packet := append([]byte(nil), tt.packet...)
+		frame := passthroughFrame(packet, true, tt.truncated, trailer)
+		if !bytes.Equal(packet, tt.packet) {
+			t.Errorf("%s: the captured packet was modified", tt.name)
+		}
+		if !hasFCS(frame) {
+			t.Errorf("%s: the frame doesn't end with a valid FCS", tt.name)
+			continue
+		}
+		original, records := trailerRecords(t, frame[:len(frame)-4])
+		if !bytes.Equal(original, tt.original) {
+			t.Errorf("%s: the frame starts with\n% x\nwant\n% x", tt.name, original, tt.original)
+		}
+		if len(records) != 1 || binary.BigEndian.Uint32(records[0][tlvPid]) != 42 || string(records[0][tlvCmd]) != "curl" {
+			t.Errorf("%s: the trailer holds %v", tt.name, records)
+		}
+	}
+}
+
+func TestPassthroughFrameNotEthernet(t *testing.T) {
+	fields := trailerFields
+	t.Cleanup(func() { trailerFields = fields })
+	trailerFields = map[uint8]bool{tlvPid: true}
+
+	// a raw IP packet ending with bytes that happen to be a valid CRC
+	packet := withFCS(bytes.Repeat([]byte{0x45}, 60))
+	frame := passthroughFrame(packet, false, false, packTrailer(&packetMetaData{Magic: tcpSharkMagic, Pid: 7}))
+	original, records := trailerRecords(t, frame)
+	if !bytes.Equal(original, packet) {
+		t.Errorf("the packet is\n% x\nwant\n% x", original, packet)
+	}
+	if len(records) != 1 || binary.BigEndian.Uint32(records[0][tlvPid]) != 7 {
+		t.Errorf("the trailer holds %v", records)
+	}
+}
+
+func TestParseTrailerFields(t *testing.T) {
+	tests := []struct {
+		list      string
+		verbosity uint8
+		fields    []uint8
+		want      uint8
+	}{
+		{"", 0, []uint8{tlvPid, tlvInode, tlvCookie}, 0},
+		{"", 1, []uint8{tlvPid, tlvInode, tlvCookie, tlvCmd}, 1},
+		{"", 2, []uint8{tlvPid, tlvInode, tlvCookie, tlvCmd, tlvArgs}, 2},
+		// --fields overrides --verbosity
+		{"pid, source", 2, []uint8{tlvPid, tlvSource}, 0},
+		{"uid,cmd", 0, []uint8{tlvUID, tlvCmd}, 1},
+		{"args,direction", 0, []uint8{tlvArgs, tlvDirection}, 2},
+	}
+	for _, tt := range tests {
+		fields, verbosity, err := parseTrailerFields(tt.list, tt.verbosity)
+		if err != nil {
+			t.Errorf("%q: %v", tt.list, err)
+			continue
+		}
+		want := map[uint8]bool{}
+		for _, f := range tt.fields {
+			want[f] = true
+		}
+		if !reflect.DeepEqual(fields, want) || verbosity != tt.want {
+			t.Errorf("%q at verbosity %d: fields %v at verbosity %d, want %v at verbosity %d", tt.list, tt.verbosity, fields, verbosity, want, tt.want)
+		}
+	}
+	if _, _, err := parseTrailerFields("pid,comm", 0); err == nil {
+		t.Error("unknown field comm was accepted")
+	}
+}
+
+func TestPackTrailer(t *testing.T) {
+	fields := trailerFields
+	t.Cleanup(func() { trailerFields = fields })
+
+	long := strings.Repeat("a", 0x10000+10)
+	curl := &packetMetaData{Magic: tcpSharkMagic, Pid: 10, Cmd: "curl", Args: "curl example.com", Inode: 100, Cookie: 0x1234, UID: 1000, Direction: directionOutgoing, Source: sourceEBPF}
+	tests := []struct {
+		name    string
+		fields  string
+		records []*packetMetaData
+		want    []map[uint8][]byte
+	}{
+		{
+			"selected fields", "pid,cmd,uid,direction,source", []*packetMetaData{curl},
+			[]map[uint8][]byte{{
+				tlvFlow: {0}, tlvPid: {0, 0, 0, 10}, tlvCmd: []byte("curl"),
+				tlvUID: {0, 0, 0x03, 0xe8}, tlvDirection: {directionOutgoing}, tlvSource: {sourceEBPF},
+			}},
+		},
+		{
+			"value cut to 0xFFFF bytes", "args", []*packetMetaData{{Magic: tcpSharkMagic, Args: long}},
+			[]map[uint8][]byte{{tlvFlow: {0}, tlvArgs: []byte(long[:0xFFFF])}},
+		},
+		{
+			"inner flow", "pid,inode", []*packetMetaData{curl, {Magic: tcpSharkMagic, Pid: 20, Inode: 200}},
+			[]map[uint8][]byte{
+				{tlvFlow: {0}, tlvPid: {0, 0, 0, 10}, tlvInode: {0, 0, 0, 0, 0, 0, 0, 100}},
+				{tlvFlow: {1}, tlvPid: {0, 0, 0, 20}, tlvInode: {0, 0, 0, 0, 0, 0, 0, 200}},
+			},
+		},
+		{
+			"inner flow of a packet without metadata", "pid", []*packetMetaData{{}, {Magic: tcpSharkMagic, Pid: 20}},
+			[]map[uint8][]byte{{tlvFlow: {1}, tlvPid: {0, 0, 0, 20}}},
+		},
+		{
+			"inventory index", "pid,cmd,args", []*packetMetaData{{Magic: tcpSharkMagic, Pid: 10, Cmd: "curl", Args: "curl example.com", Index: 3}},
+			[]map[uint8][]byte{{tlvFlow: {0}, tlvPid: {0, 0, 0, 10}, tlvIndex: {0, 0, 0, 3}}},
+		},
+		{"no records", "pid", nil, nil},
+	}
+	for _, tt := range tests {
+		var err error
+		trailerFields, _, err = parseTrailerFields(tt.fields, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		before, records := trailerRecords(t, packTrailer(tt.records...))
+		if len(before) != 0 {
+			t.Errorf("%s: % x before the trailer", tt.name, before)
+		}
+		if !reflect.DeepEqual(records, tt.want) {
+			t.Errorf("%s: records %v, want %v", tt.name, records, tt.want)
+		}
+	}
+}
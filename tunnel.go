@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/netip"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+)
+
+// tunnelName returns the name of the encapsulation started by layer. ipSeen
+// tells whether an IP layer was already decoded before it, in which case a
+// second IP layer is an IP-in-IP tunnel
+func tunnelName(layer gopacket.Layer, ipSeen bool) (string, bool) {
+	switch layer.LayerType() {
+	case layers.LayerTypeVXLAN:
+		return "vxlan", true
+	case layers.LayerTypeGeneve:
+		return "geneve", true
+	case layers.LayerTypeGRE:
+		return "gre", true
+	case layers.LayerTypeIPv4, layers.LayerTypeIPv6:
+		if ipSeen {
+			return "ipip", true
+		}
+	}
+	return "", false
+}
+
+// isWireGuard tells whether a UDP payload is a WireGuard message, from its
+// type, the three reserved zero bytes after it and its length. The inner flow
+// is encrypted, only the cleartext side captured on the WireGuard interface
+// can be attributed
+func isWireGuard(payload []byte) bool {
+	if len(payload) < 4 || payload[1] != 0 || payload[2] != 0 || payload[3] != 0 {
+		return false
+	}
+	switch payload[0] {
+	case 1: // handshake initiation
+		return len(payload) == 148
+	case 2: // handshake response
+		return len(payload) == 92
+	case 3: // cookie reply
+		return len(payload) == 64
+	case 4: // transport data, padded to 16 bytes and followed by a 16 bytes tag
+		return len(payload) >= 32 && len(payload)%16 == 0
+	}
+	return false
+}
+
+// ipAddrs returns the addresses of an IP layer
+func ipAddrs(layer gopacket.Layer) (src, dst netip.Addr, ok bool) {
+	switch l := layer.(type) {
+	case *layers.IPv4:
+		src, _ = netip.AddrFromSlice(l.SrcIP)
+		dst, _ = netip.AddrFromSlice(l.DstIP)
+	case *layers.IPv6:
+		src, _ = netip.AddrFromSlice(l.SrcIP)
+		dst, _ = netip.AddrFromSlice(l.DstIP)
+	default:
+		return src, dst, false
+	}
+	return src.Unmap(), dst.Unmap(), true
+}
+
+// tunnelEndpoint is the metadata of a tunnel terminated in the kernel, which
+// has no owning process. The name is bracketed like kernel threads in ps
+func tunnelEndpoint(name string) packetMetaData {
+	cmd := "[" + name + "]"
+	return packetMetaData{
+		Magic:  tcpSharkMagic,
+		Cmd:    cmd,
+		Source: sourceTunnel,
+	}
+}
+
+// attributeLayers walks the decoded layers of a packet. outer is the
+// attribution of the outermost flow. If the packet is encapsulated, the outer
+// header is attributed to the process owning the tunnel socket, or to the
+// kernel tunnel endpoint, and inner is the attribution of the innermost flow,
+// looked up by address in the other network namespaces. inner is nil for
+// packets that are not tunnelled
+func attributeLayers(verbosity uint8, packetLayers []gopacket.Layer) (outer packetMetaData, inner *packetMetaData) {
+	tunnel := ""
+	ipSeen := false
+	var srcAddr, dstAddr netip.Addr
+	for _, layer := range packetLayers {
+		if name, ok := tunnelName(layer, ipSeen); ok && tunnel == "" {
+			tunnel = name
+			if outer.Pid == 0 {
+				outer = tunnelEndpoint(name)
+			}
+		}
+		if src, dst, ok := ipAddrs(layer); ok {
+			ipSeen = true
+			srcAddr, dstAddr = src, dst
+		}
+		srcPort, dstPort, ok := transportPorts(layer)
+		if !ok {
+			continue
+		}
+		if tunnel == "" {
+			outer = lookupProcess(verbosity, transportProtocol(layer), srcPort, dstPort)
+			// kernel WireGuard sockets have no owning process
+			if udp, ok := layer.(*layers.UDP); ok && outer.Pid == 0 && isWireGuard(udp.Payload) {
+				tunnel = "wireguard"
+				outer = tunnelEndpoint(tunnel)
+			}
+		} else {
+			m := lookupInnerProcess(verbosity, transportProtocol(layer), srcAddr, dstAddr, srcPort, dstPort)
+			inner = &m
+		}
+	}
+	if inner == nil && tunnel != "" {
+		m := packetMetaData{Magic: tcpSharkMagic}
+		inner = &m
+	}
+	return outer, inner
+}